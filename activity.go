@@ -0,0 +1,190 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// one transmission, from squelch open to close
+type activityEvent struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Freq   uint32    `json:"frequency"`
+	Label  string    `json:"label,omitempty"`
+	Mode   string    `json:"mode"`
+	PeakDb float64   `json:"peak_db"`
+	MeanDb float64   `json:"mean_db"`
+	Tone   float64   `json:"tone,omitempty"`
+}
+
+var activityFields = []string{"start", "end", "frequency", "label", "mode", "peak_db", "mean_db", "tone"}
+
+// Log of transmissions, JSON lines by .json/.jsonl extension otherwise CSV.
+// Shared by every channel so writes are serialised.
+type activityLog struct {
+	mu   sync.Mutex
+	file *os.File
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+// Tracks squelch on one demodulator, logging each transmission as it ends
+// to the log and discovery, either of which may be nil
+type activity struct {
+	log   *activityLog
+	disc  *discovery
+	entry *scanEntry
+	mode  string
+	open  bool
+	start time.Time
+	peak  float64
+	power float64
+	n     int
+	tone  float64
+}
+
+var activityLogger *activityLog
+
+// Open name for appending, a new CSV gets a header row
+func newActivityLog(name string) (*activityLog, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l := &activityLog{file: f}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".jsonl":
+		l.json = json.NewEncoder(f)
+	default:
+		l.csv = csv.NewWriter(f)
+		if info.Size() == 0 {
+			l.csv.Write(activityFields)
+			l.csv.Flush()
+		}
+	}
+	return l, nil
+}
+
+func (l *activityLog) write(ev *activityEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	if l.json != nil {
+		err = l.json.Encode(ev)
+	} else {
+		var tone string
+		if ev.Tone > 0 {
+			tone = strconv.FormatFloat(ev.Tone, 'f', 1, 64)
+		}
+		l.csv.Write([]string{
+			ev.Start.Format(time.RFC3339),
+			ev.End.Format(time.RFC3339),
+			strconv.Itoa(int(ev.Freq)),
+			ev.Label,
+			ev.Mode,
+			strconv.FormatFloat(ev.PeakDb, 'f', 1, 64),
+			strconv.FormatFloat(ev.MeanDb, 'f', 1, 64),
+			tone,
+		})
+		l.csv.Flush()
+		err = l.csv.Error()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write activity log: %s\n", err)
+	}
+}
+
+func (l *activityLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+}
+
+func newActivity(l *activityLog, disc *discovery) *activity {
+	return &activity{log: l, disc: disc}
+}
+
+// Called after each block is demodulated with whether squelch is open, the
+// entry being listened to and the block's signal level in dB
+func (a *activity) update(open bool, e *scanEntry, mode string, db float64, tone *toneDecoder) {
+	if a.open && (!open || e != a.entry) {
+		a.finish()
+	}
+	if !open {
+		return
+	}
+
+	if !a.open {
+		a.open = true
+		a.entry = e
+		a.mode = mode
+		a.start = time.Now()
+		a.peak = db
+		a.power = 0
+		a.n = 0
+		a.tone = 0
+	}
+	if db > a.peak {
+		a.peak = db
+	}
+	a.power += math.Pow(10, db/10)
+	a.n++
+	if tone != nil && tone.tone > 0 {
+		a.tone = tone.tone
+	}
+}
+
+// log the transmission in progress, if any
+func (a *activity) finish() {
+	if !a.open {
+		return
+	}
+	a.open = false
+	ev := &activityEvent{
+		Start:  a.start,
+		End:    time.Now(),
+		Freq:   a.entry.freq,
+		Label:  a.entry.label,
+		Mode:   a.mode,
+		PeakDb: round(a.peak*10) / 10,
+		MeanDb: round(100*math.Log10(a.power/float64(a.n))) / 10,
+		Tone:   a.tone,
+	}
+	if a.log != nil {
+		a.log.write(ev)
+	}
+	if a.disc != nil {
+		a.disc.add(ev, a.entry)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"time"
+)
+
+const (
+	// seconds of signal for the correction to settle
+	afcTau = 10.0
+	// retune once the correction has moved this far, Hz
+	afcStep = 25
+	// more than warm up drift, something is wrong
+	afcMaxPpm = 30
+)
+
+// Automatic frequency control
+//
+// Dongle crystals drift as they warm up, which moves every channel by the
+// same number of ppm. The average FM discriminator output while squelch is
+// open is how far the signal is from where we're tuned, and slowly pulls
+// the estimate. The controller applies it, on top of -p, when tuning.
+type afcState struct {
+	// estimated error in the same sense as -p, positive when the crystal
+	// is fast and signals appear low
+	ppm  float64
+	sent float64
+	// estimates for the controller to apply
+	ppmChan chan float64
+	// correction the dongle is tuned with, written with controller.mu held
+	applied float64
+}
+
+func newAfc() *afcState {
+	return &afcState{ppmChan: make(chan float64, 1)}
+}
+
+// Update the estimate from a block of discriminator output at rate, heard
+// on freq
+func (a *afcState) measure(pcm []int16, rate int, freq uint32) {
+	if len(pcm) == 0 || freq == 0 {
+		return
+	}
+	var sum int64
+	for _, v := range pcm {
+		sum += int64(v)
+	}
+	// π is 1<<14
+	offset := float64(sum) / float64(len(pcm)) * float64(rate) / (2 << 14)
+
+	k := float64(len(pcm)) / float64(rate) / afcTau
+	a.ppm -= k * offset / float64(freq) * 1e6
+	a.ppm = math.Max(-afcMaxPpm, math.Min(afcMaxPpm, a.ppm))
+
+	if math.Abs(a.ppm-a.sent)*float64(freq)/1e6 < afcStep {
+		return
+	}
+	a.sent = a.ppm
+	// the controller only needs the latest
+	select {
+	case <-a.ppmChan:
+	default:
+	}
+	a.ppmChan <- a.ppm
+}
+
+// called by the controller with a new estimate
+func (a *afcState) apply(ppm float64) error {
+	controller.mu.Lock()
+	a.applied = ppm
+	controller.mu.Unlock()
+	err := dongle.dev.SetCenterFreq(tunerFreq())
+	if err != nil {
+		return fmt.Errorf("Error setting frequency %d", tunerFreq())
+	}
+	fmt.Fprintf(os.Stderr, "%s AFC drift %+.2f ppm, retuned %+d Hz\n", time.Now().Format("15:04:05"),
+		ppm, tunerFreq()-int(dongle.freq))
+	return nil
+}
+
+// the discriminator output is only a frequency for FM
+func (d *demodState) isFm() bool {
+	return reflect.ValueOf(d.modeDemod).Pointer() == reflect.ValueOf(fmDemod).Pointer()
+}
+
+// frequency to tune the dongle to for dongle.freq, with the AFC correction
+// and satellite Doppler
+func tunerFreq() int {
+	f := int(dongle.freq)
+	if demod.afc != nil {
+		f -= int(round(float64(dongle.freq) * demod.afc.applied / 1e6))
+	}
+	if s := controller.sat; s != nil && s.pass != nil {
+		f += s.shift
+	}
+	return f
+}
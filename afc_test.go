@@ -0,0 +1,64 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAfcConverges(t *testing.T) {
+	const (
+		rate = 24000
+		freq = 145500000
+	)
+	tests := []struct {
+		// crystal error, and the estimate it should settle on
+		ppm, want float64
+	}{
+		{0, 0},
+		{5, 5},
+		{-12.5, -12.5},
+		{50, afcMaxPpm},
+	}
+	for _, tt := range tests {
+		a := newAfc()
+		pcm := make([]int16, rate/10)
+		var sent float64
+		// ten time constants in 0.1s blocks
+		for i := 0; i < int(10*afcTau*10); i++ {
+			// a fast crystal puts the signal low, less what's corrected
+			offset := -(tt.ppm - sent) * freq / 1e6
+			for j := range pcm {
+				pcm[j] = int16(math.Max(-32768, math.Min(32767, offset*(2<<14)/rate)))
+			}
+			a.measure(pcm, rate, freq)
+			select {
+			case sent = <-a.ppmChan:
+			default:
+			}
+		}
+		// to within a retuning step
+		if math.Abs(a.ppm-tt.want)*freq/1e6 > afcStep {
+			t.Errorf("%.1f ppm: estimated %.2f ppm, want %.1f", tt.ppm, a.ppm, tt.want)
+		}
+		// retuned once it's off by afcStep
+		if math.Abs(sent-tt.want)*freq/1e6 > afcStep {
+			t.Errorf("%.1f ppm: %.2f ppm sent to the controller", tt.ppm, sent)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+type agcPreset struct {
+	attack time.Duration
+	decay  time.Duration
+	hang   time.Duration
+}
+
+var agcPresets = map[string]agcPreset{
+	"fast":   {attack: 2 * time.Millisecond, decay: 100 * time.Millisecond},
+	"medium": {attack: 2 * time.Millisecond, decay: 250 * time.Millisecond, hang: 250 * time.Millisecond},
+	"slow":   {attack: 2 * time.Millisecond, decay: 1000 * time.Millisecond, hang: 500 * time.Millisecond},
+}
+
+// Peak AGC with look-ahead
+//
+// The envelope is measured on samples entering a delay line and the gain is
+// applied to samples leaving it. The delay equals the attack time, and the
+// gain ramps down within that time, so it has already come down by the time
+// a peak reaches the output.
+type agcState struct {
+	attack     time.Duration
+	decay      time.Duration
+	hang       time.Duration
+	gainMax    float64
+	peakTarget float64
+	// hold the envelope, e.g. while squelched
+	hold bool
+
+	env         float64
+	g           float64
+	attackCoef  float64
+	decayCoef   float64
+	hangSamples int
+	hangCount   int
+	delay       []int16
+	pos         int
+}
+
+func (a *agcState) setPreset(name string) error {
+	p, ok := agcPresets[name]
+	if !ok {
+		return fmt.Errorf("Unknown AGC preset '%s'", name)
+	}
+	a.attack = p.attack
+	a.decay = p.decay
+	a.hang = p.hang
+	return nil
+}
+
+// derive per sample coefficients, must be called before use
+func (a *agcState) setup(rate int) {
+	samples := func(d time.Duration) float64 {
+		return d.Seconds() * float64(rate)
+	}
+
+	// within 2% of target by the end of the look-ahead
+	a.attackCoef = 1
+	if n := samples(a.attack); n > 1 {
+		a.attackCoef = 1 - math.Exp(-4/n)
+	}
+	a.decayCoef = 1
+	if n := samples(a.decay); n > 1 {
+		a.decayCoef = 1 - math.Exp(-1/n)
+	}
+	a.hangSamples = int(samples(a.hang))
+	a.delay = make([]int16, int(samples(a.attack))+1)
+	a.pos = 0
+	a.setGain(1)
+}
+
+// current gain, for per-channel memory
+func (a *agcState) gain() float64 {
+	return a.g
+}
+
+// restore a gain previously returned by gain(), 0 resets to unity. The
+// envelope starts again from the gain.
+func (a *agcState) setGain(g float64) {
+	if g <= 0 {
+		g = 1
+	}
+	a.g = g
+	a.env = a.peakTarget / g
+	a.hangCount = 0
+}
+
+// drop the audio waiting in the look-ahead, from the channel just left
+func (a *agcState) flush() {
+	for i := range a.delay {
+		a.delay[i] = 0
+	}
+	a.pos = 0
+}
+
+func softwareAgc(d *demodState) {
+	a := &d.agc
+	for i, s := range d.lowpassed {
+		level := math.Abs(float64(s))
+
+		if !a.hold {
+			switch {
+			case level > a.env:
+				a.env = level
+				a.hangCount = a.hangSamples
+			case a.hangCount > 0:
+				a.hangCount--
+			default:
+				a.env -= a.env * a.decayCoef
+			}
+
+			target := a.gainMax
+			if a.env > 0 {
+				target = math.Min(a.peakTarget/a.env, a.gainMax)
+			}
+			// the envelope decay already limits how fast gain rises
+			if target < a.g {
+				a.g += (target - a.g) * a.attackCoef
+			} else {
+				a.g = target
+			}
+		}
+
+		out := a.delay[a.pos]
+		a.delay[a.pos] = s
+		a.pos = (a.pos + 1) % len(a.delay)
+
+		d.lowpassed[i] = clip16(float64(out) * a.g)
+	}
+}
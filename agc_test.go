@@ -0,0 +1,65 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAgcChannelChange(t *testing.T) {
+	const rate = 24000
+	tests := []struct {
+		name string
+		// gain kept for the channel tuned to
+		gain float64
+	}{
+		{"new channel", 0},
+		{"remembered gain", 8},
+	}
+	for _, tt := range tests {
+		d := &demodState{agc: agcState{peakTarget: 1 << 14, gainMax: 256}}
+		d.agc.setPreset("medium")
+		d.agc.setup(rate)
+
+		// a loud carrier right up to the hop
+		d.lowpassed = make([]int16, rate/10)
+		for i := range d.lowpassed {
+			d.lowpassed[i] = int16(20000 * math.Sin(float64(i)))
+		}
+		softwareAgc(d)
+
+		d.agc.setGain(tt.gain)
+		d.agc.flush()
+		d.lowpassed = make([]int16, rate/10)
+		softwareAgc(d)
+		for i, s := range d.lowpassed {
+			if s != 0 {
+				t.Fatalf("%s: sample %d from the last channel", tt.name, i)
+			}
+		}
+
+		want := tt.gain
+		if want == 0 {
+			want = 1
+		}
+		// the envelope followed the gain, silence only lets it decay
+		if d.agc.g < want || d.agc.env > d.agc.peakTarget/want {
+			t.Errorf("%s: gain %.2f envelope %.0f after the hop, want gain %.2f", tt.name, d.agc.g, d.agc.env, want)
+		}
+	}
+}
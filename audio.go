@@ -0,0 +1,235 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	wavHeaderLen = 44
+	// sizes are fixed up this often so a killed recording is still readable
+	wavSync = 5 * time.Second
+)
+
+// Where demodulated audio goes, a file or stdout
+type audioWriter interface {
+	write(buf []int16) error
+	close() error
+}
+
+// set from the command line, for WAV files
+var wavFloat, wavStereo bool
+
+// format of files written into a directory, by -record and -sat-record
+var recordFormat = "raw"
+
+var audioFormats = map[string]bool{
+	"raw":  true,
+	"wav":  true,
+	"flac": true,
+}
+
+// Vorbis comments for a recording of e starting at t
+func audioTags(e *scanEntry, mode string, t time.Time) []string {
+	tags := []string{
+		"FREQUENCY=" + strconv.Itoa(int(e.freq)),
+		"MODE=" + mode,
+		"DATE=" + t.Format(time.RFC3339),
+	}
+	if e.label != "" {
+		tags = append(tags, "TITLE="+e.label)
+	}
+	return tags
+}
+
+// Open name for audio at rate, the format chosen by its extension. Existing
+// files are appended to, or truncated if appending isn't set. Tags are
+// written to new FLAC files.
+func openAudio(name string, rate int, appending bool, tags []string) (audioWriter, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if !appending {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(name, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".wav":
+		w, err := newWavWriter(f, rate)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		return w, nil
+	case ".flac":
+		w, err := newFlacWriter(f, rate, tags)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		return w, nil
+	default:
+		_, err = f.Seek(0, io.SeekEnd)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &rawWriter{w: f}, nil
+	}
+}
+
+// headerless little endian int16
+type rawWriter struct {
+	w io.WriteCloser
+}
+
+func (r *rawWriter) write(buf []int16) error {
+	return binary.Write(r.w, binary.LittleEndian, buf)
+}
+
+func (r *rawWriter) close() error {
+	return r.w.Close()
+}
+
+// for writers such as stdout that outlive the output
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// WAV file, 16 bit or float, mono or with the audio on both channels
+type wavWriter struct {
+	f        *os.File
+	float    bool
+	channels int
+	rate     int
+	// bytes of samples written
+	size   int64
+	synced time.Time
+	out    []byte
+}
+
+// Write a new header, or check an existing one matches so it can be
+// appended to
+func newWavWriter(f *os.File, rate int) (*wavWriter, error) {
+	w := &wavWriter{
+		f:        f,
+		float:    wavFloat,
+		channels: 1,
+		rate:     rate,
+		synced:   time.Now(),
+	}
+	if wavStereo {
+		w.channels = 2
+	}
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if end == 0 {
+		_, err = f.Write(w.header())
+		return w, err
+	}
+
+	existing := make([]byte, wavHeaderLen)
+	_, err = f.ReadAt(existing, 0)
+	if err != nil || string(existing[:4]) != "RIFF" || !bytes.Equal(existing[8:36], w.header()[8:36]) {
+		return nil, fmt.Errorf("existing file isn't a WAV file in the same format")
+	}
+	w.size = end - wavHeaderLen
+	return w, nil
+}
+
+func (w *wavWriter) header() []byte {
+	bits := 16
+	format := 1
+	if w.float {
+		bits = 32
+		format = 3
+	}
+	align := w.channels * bits / 8
+
+	h := new(bytes.Buffer)
+	h.WriteString("RIFF")
+	binary.Write(h, binary.LittleEndian, uint32(36+w.size))
+	h.WriteString("WAVEfmt ")
+	binary.Write(h, binary.LittleEndian, []uint32{16})
+	binary.Write(h, binary.LittleEndian, []uint16{uint16(format), uint16(w.channels)})
+	binary.Write(h, binary.LittleEndian, []uint32{uint32(w.rate), uint32(w.rate * align)})
+	binary.Write(h, binary.LittleEndian, []uint16{uint16(align), uint16(bits)})
+	h.WriteString("data")
+	binary.Write(h, binary.LittleEndian, uint32(w.size))
+	return h.Bytes()
+}
+
+func (w *wavWriter) write(buf []int16) error {
+	width := 2
+	if w.float {
+		width = 4
+	}
+	w.out = w.out[:0]
+	for _, s := range buf {
+		var b [4]byte
+		if w.float {
+			binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(s)/32768))
+		} else {
+			binary.LittleEndian.PutUint16(b[:], uint16(s))
+		}
+		for c := 0; c < w.channels; c++ {
+			w.out = append(w.out, b[:width]...)
+		}
+	}
+	n, err := w.f.Write(w.out)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if time.Since(w.synced) > wavSync {
+		return w.sync()
+	}
+	return nil
+}
+
+// fix up the sizes in the header
+func (w *wavWriter) sync() error {
+	w.synced = time.Now()
+	_, err := w.f.WriteAt(w.header(), 0)
+	return err
+}
+
+func (w *wavWriter) close() error {
+	err := w.sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
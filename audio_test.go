@@ -0,0 +1,265 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type wavHeader struct {
+	riffSize, fmtSize         uint32
+	format, channels          uint16
+	rate, byteRate            uint32
+	align, bits               uint16
+	dataSize                  uint32
+	riff, wave, fmtId, dataId [4]byte
+}
+
+// parse name as written by wavWriter, giving the samples of the first channel
+func readWav(t *testing.T, name string) (*wavHeader, []int16) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < wavHeaderLen {
+		t.Fatalf("%s: %d bytes", name, len(data))
+	}
+	h := &wavHeader{}
+	r := bytes.NewReader(data)
+	for _, v := range []interface{}{
+		&h.riff, &h.riffSize, &h.wave, &h.fmtId, &h.fmtSize, &h.format, &h.channels,
+		&h.rate, &h.byteRate, &h.align, &h.bits, &h.dataId, &h.dataSize,
+	} {
+		binary.Read(r, binary.LittleEndian, v)
+	}
+	if string(h.riff[:]) != "RIFF" || string(h.wave[:]) != "WAVE" || string(h.fmtId[:]) != "fmt " ||
+		string(h.dataId[:]) != "data" || h.fmtSize != 16 {
+		t.Fatalf("%s: bad header %+v", name, *h)
+	}
+	if int(h.riffSize) != len(data)-8 || int(h.dataSize) != len(data)-wavHeaderLen {
+		t.Errorf("%s: RIFF size %d, data size %d for %d bytes", name, h.riffSize, h.dataSize, len(data))
+	}
+
+	var x []int16
+	body := data[wavHeaderLen:]
+	for i := 0; i+int(h.align) <= len(body); i += int(h.align) {
+		if h.format == 3 {
+			f := math.Float32frombits(binary.LittleEndian.Uint32(body[i:]))
+			x = append(x, int16(f*32768))
+		} else {
+			x = append(x, int16(binary.LittleEndian.Uint16(body[i:])))
+		}
+		// both channels carry the same audio
+		if h.channels == 2 && !bytes.Equal(body[i:i+int(h.align)/2], body[i+int(h.align)/2:i+int(h.align)]) {
+			t.Fatalf("%s: channels differ at %d", name, i)
+		}
+	}
+	return h, x
+}
+
+func sameSamples(t *testing.T, name string, got, want []int16) {
+	if len(got) != len(want) {
+		t.Fatalf("%s: %d samples, want %d", name, len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("%s: sample %d is %d, want %d", name, i, got[i], want[i])
+		}
+	}
+}
+
+func TestWavHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { wavFloat, wavStereo = false, false }()
+
+	x := []int16{0, 1, -1, 32767, -32768, 1000, -1000}
+	tests := []struct {
+		name          string
+		float, stereo bool
+		format        uint16
+		channels      uint16
+		bits          uint16
+	}{
+		{"int mono", false, false, 1, 1, 16},
+		{"int stereo", false, true, 1, 2, 16},
+		{"float mono", true, false, 3, 1, 32},
+		{"float stereo", true, true, 3, 2, 32},
+	}
+	for _, tt := range tests {
+		wavFloat, wavStereo = tt.float, tt.stereo
+		name := filepath.Join(dir, tt.name+".wav")
+		w, err := openAudio(name, 24000, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.write(x); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		h, got := readWav(t, name)
+		align := tt.channels * tt.bits / 8
+		if h.format != tt.format || h.channels != tt.channels || h.bits != tt.bits || h.rate != 24000 ||
+			h.align != align || h.byteRate != 24000*uint32(align) {
+			t.Errorf("%s: header %+v", tt.name, *h)
+		}
+		sameSamples(t, tt.name, got, x)
+	}
+}
+
+func TestWavAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { wavFloat, wavStereo = false, false }()
+
+	a, b := []int16{1, 2, 3}, []int16{4, 5}
+	tests := []struct {
+		name      string
+		appending bool
+		want      []int16
+	}{
+		{"append", true, []int16{1, 2, 3, 4, 5}},
+		{"truncate", false, []int16{4, 5}},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.name+".wav")
+		for i, x := range [][]int16{a, b} {
+			w, err := openAudio(name, 24000, i == 0 || tt.appending, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.write(x); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, got := readWav(t, name)
+		sameSamples(t, tt.name, got, tt.want)
+	}
+
+	// existing files that can't be appended to
+	name := filepath.Join(dir, "append.wav")
+	mismatched := []struct {
+		name          string
+		rate          int
+		float, stereo bool
+	}{
+		{"rate", 48000, false, false},
+		{"float", 24000, true, false},
+		{"stereo", 24000, false, true},
+	}
+	for _, tt := range mismatched {
+		wavFloat, wavStereo = tt.float, tt.stereo
+		if w, err := openAudio(name, tt.rate, true, nil); err == nil {
+			w.close()
+			t.Errorf("appended with a different %s", tt.name)
+		}
+	}
+	wavFloat, wavStereo = false, false
+
+	other := filepath.Join(dir, "other.wav")
+	if err := ioutil.WriteFile(other, append([]byte("fLaC"), make([]byte, 100)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openAudio(other, 24000, true, nil); err == nil {
+		t.Errorf("appended to a file that isn't WAV")
+	}
+	// and left alone
+	if data, _ := ioutil.ReadFile(other); len(data) != 104 {
+		t.Errorf("file that isn't WAV is now %d bytes", len(data))
+	}
+}
+
+// a killed recording is readable up to its last sync
+func TestWavSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "killed.wav")
+	out, err := openAudio(name, 24000, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := out.(*wavWriter)
+	x := []int16{1, 2, 3, 4}
+	if err := w.write(x); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.sync(); err != nil {
+		t.Fatal(err)
+	}
+	w.f.Close()
+
+	_, got := readWav(t, name)
+	sameSamples(t, name, got, x)
+}
+
+type closeCounter struct {
+	bytes.Buffer
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestRawWriter(t *testing.T) {
+	var c closeCounter
+	tests := []struct {
+		name   string
+		w      *rawWriter
+		closed int
+	}{
+		{"file", &rawWriter{w: &c}, 1},
+		// stdout stays open
+		{"stdout", &rawWriter{w: nopCloser{&c}}, 0},
+	}
+	for _, tt := range tests {
+		c.Reset()
+		c.closed = 0
+		if err := tt.w.write([]int16{1, -2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tt.w.close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(c.Bytes(), []byte{1, 0, 0xfe, 0xff}) || c.closed != tt.closed {
+			t.Errorf("%s: wrote %x, closed %d times", tt.name, c.Bytes(), c.closed)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	rtl "github.com/jpoirier/gortlsdr"
+)
+
+const (
+	calibrateRate = 1024000
+	// 15.6Hz bins, interpolated to better than 1Hz
+	calibrateBins = 1 << 16
+	// the carrier is kept clear of the DC spike
+	calibrateOffset = calibrateRate / 4
+	// worst dongle crystal error searched for
+	calibrateMaxPpm = 200
+	// carrier must be this far above the noise floor
+	calibrateSnr = 10
+)
+
+// default file of ppm errors by dongle serial number
+func calibrationPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "hamsdr", "calibration")
+}
+
+// Read the ppm errors saved by hamsdr calibrate, serial number then ppm on
+// each line. A missing file is empty.
+func loadCalibration(name string) (map[string]float64, error) {
+	cal := make(map[string]float64)
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return cal, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: bad line '%s'", name, line)
+		}
+		ppm, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad ppm '%s'", name, fields[1])
+		}
+		cal[fields[0]] = ppm
+	}
+	return cal, scanner.Err()
+}
+
+func saveCalibration(name, serial string, ppm float64) error {
+	cal, err := loadCalibration(name)
+	if err != nil {
+		return err
+	}
+	cal[serial] = ppm
+
+	var serials []string
+	for s := range cal {
+		serials = append(serials, s)
+	}
+	sort.Strings(serials)
+
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "# hamsdr dongle ppm errors, serial ppm")
+	for _, s := range serials {
+		fmt.Fprintf(w, "%s %.1f\n", s, cal[s])
+	}
+	return w.Flush()
+}
+
+// ppm error saved for the dongle, ok false if it hasn't been calibrated
+func savedPpm(name string, devIndex int) (ppm float64, ok bool, err error) {
+	_, _, serial, err := rtl.GetDeviceUsbStrings(devIndex)
+	if err != nil || serial == "" {
+		return 0, false, err
+	}
+	cal, err := loadCalibration(name)
+	if err != nil {
+		return 0, false, err
+	}
+	ppm, ok = cal[serial]
+	return ppm, ok, nil
+}
+
+// hamsdr calibrate, measure the ppm error of a dongle from a carrier on a
+// known frequency
+//
+// The dongle is tuned below the carrier so that it's clear of the DC spike,
+// and its frequency found from the peak of an averaged FFT. Both the tuner
+// and the sample clock run from the crystal, so a carrier at f is measured
+// at f/(1+ppm/1e6) - centre.
+func calibrateMain(args []string) {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	devIndex := fs.Int("d", 0, "dongle device index")
+	freqStr := fs.String("f", "", "frequency of a steady reference carrier e.g. 162.55M")
+	gain := fs.Int("g", autoGain, "gain level (defaults to autogain)")
+	duration := fs.Duration("t", 10*time.Second, "how long to measure")
+	save := fs.Bool("save", false, "save the ppm error for this dongle, used by later runs without -p")
+	calFile := fs.String("cal-file", calibrationPath(), "file of saved ppm errors")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s calibrate -f frequency [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *freqStr == "" {
+		fs.Usage()
+		return
+	}
+	ref, err := freqHz(*freqStr)
+	if err != nil || ref <= calibrateOffset {
+		fmt.Fprintf(os.Stderr, "Bad frequency '%s'\n", *freqStr)
+		return
+	}
+
+	_, _, serial, err := rtl.GetDeviceUsbStrings(*devIndex)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read dongle serial number: %s\n", err)
+		return
+	}
+	if *save && serial == "" {
+		fmt.Fprintln(os.Stderr, "Dongle has no serial number, the ppm error can't be saved")
+		return
+	}
+
+	dev, err := rtl.Open(*devIndex)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open dongle, '%s', exiting\n", err)
+		return
+	}
+	defer dev.Close()
+
+	centre := int(ref) - calibrateOffset
+	err = dev.SetSampleRate(calibrateRate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting sample rate %d\n", calibrateRate)
+		return
+	}
+	err = dev.SetCenterFreq(centre)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting frequency %d\n", centre)
+		return
+	}
+	if *gain == autoGain {
+		err = dev.SetTunerGainMode(false)
+	} else {
+		var g int
+		g, err = nearestGain(dev, *gain*10)
+		if err == nil {
+			err = dev.SetTunerGain(g)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting tuner gain: %s\n", err)
+		return
+	}
+	err = dev.ResetBuffer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Measuring %d Hz for %s\n", ref, *duration)
+	spec := newSpectrum(calibrateBins)
+	buf := make([]byte, 4*calibrateBins)
+	// the first read is from before the tuner settled
+	_, err = dev.ReadSync(buf, len(buf))
+	for start := time.Now(); err == nil && time.Since(start) < *duration; {
+		_, err = dev.ReadSync(buf, len(buf))
+		spec.addRaw(buf)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ReadSync failed, err %s\n", err)
+		return
+	}
+
+	offset, err := carrierOffset(spec.db(), float64(ref)*calibrateMaxPpm/1e6)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	ppm := (float64(ref)/(float64(centre)+offset) - 1) * 1e6
+	fmt.Fprintf(os.Stderr, "Carrier %.0f Hz from expected, ppm error %.1f\n", offset-calibrateOffset, ppm)
+	fmt.Printf("%.1f\n", ppm)
+
+	if *save {
+		err = saveCalibration(*calFile, serial, ppm)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save calibration: %s\n", err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Saved for dongle %s in %s\n", serial, *calFile)
+	}
+}
+
+// Frequency of the strongest carrier within span Hz of calibrateOffset,
+// relative to the centre of the spectrum
+func carrierOffset(db []float64, span float64) (float64, error) {
+	n := len(db)
+	binHz := float64(calibrateRate) / float64(n)
+	mid := n/2 + calibrateOffset*n/calibrateRate
+	width := int(span/binHz) + 1
+	// stay clear of the DC spike and the band edge
+	if limit := mid - n/2 - 8; width > limit {
+		width = limit
+	}
+
+	peak := mid
+	for i := mid - width; i <= mid+width; i++ {
+		if db[i] > db[peak] {
+			peak = i
+		}
+	}
+
+	floor := median(db[mid-width : mid+width+1])
+	if db[peak]-floor < calibrateSnr {
+		return 0, fmt.Errorf("No carrier found, strongest %.1f dB above the noise", db[peak]-floor)
+	}
+
+	// parabola through the peak and its neighbours
+	a, b, c := db[peak-1], db[peak], db[peak+1]
+	frac := 0.0
+	if d := a - 2*b + c; d != 0 {
+		frac = 0.5 * (a - c) / d
+	}
+	frac = math.Max(-0.5, math.Min(0.5, frac))
+	return (float64(peak-n/2) + frac) * binHz, nil
+}
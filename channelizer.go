@@ -0,0 +1,449 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"sync"
+)
+
+const (
+	// highest sample rate the dongle runs reliably at
+	maximumCaptureRate = 2400000
+	// fraction of the capture clear of the anti-alias roll off
+	usableBandwidth = 0.8
+	// prototype filter taps for each step of decimation
+	tapsPerDecim = 12
+	// taps of each channel's filter, which halves the filter bank rate
+	channelTaps = 56
+)
+
+// Channelizer demodulates every channel inside one wideband capture
+//
+// A polyphase filter bank splits the capture into bins spaced at most a
+// quarter of its output rate apart, for a cost per sample that doesn't
+// grow with the number of channels. Each channel takes the bin nearest
+// it, is mixed down by the rest of its offset and filtered to demod
+// rateIn, then demodulated in its own goroutine with its own demodState.
+type channelizerState struct {
+	centre uint32
+	rate   int
+	// capture rate over demod rateIn
+	decim    int
+	bank     *filterBank
+	channels []*channel
+}
+
+type channel struct {
+	entry *scanEntry
+	demod *demodState
+	bin   int
+	tuner *channelTuner
+	rec   *recorder
+
+	in  chan []complex128
+	out chan []int16
+	// squelch level from the controller, taken up between captures
+	squelch chan int
+}
+
+// Oversampled polyphase analysis filter bank, m bins decimated by d. Bin k
+// is the input band pass filtered around k*rate/m, still at that offset.
+type filterBank struct {
+	m    int
+	d    int
+	taps []float64
+	// history is doubled so a full window is always contiguous
+	hist  []complex128
+	pos   int
+	count int
+	// prototype filter folded into m branches, then transformed
+	branch []complex128
+	plan   *fftPlan
+}
+
+// Mixes a bin down by the whole of its channel's offset and filters it to
+// half the filter bank rate
+type channelTuner struct {
+	phasor complex128
+	rot    complex128
+	taps   []float64
+	hist   []complex128
+	pos    int
+	odd    bool
+}
+
+var channelizer *channelizerState
+
+// Choose a capture covering the entries and set up a channel for each one
+// that isn't locked out
+func newChannelizer(s *controllerState, proto *demodState) (*channelizerState, error) {
+	var freqs []uint32
+	for _, e := range s.entries {
+		if !s.lockedOut(e) {
+			freqs = append(freqs, e.freq)
+		}
+	}
+	if len(freqs) == 0 {
+		return nil, fmt.Errorf("All channels are locked out")
+	}
+
+	lo, hi := freqs[0], freqs[0]
+	for _, f := range freqs {
+		if f < lo {
+			lo = f
+		}
+		if f > hi {
+			hi = f
+		}
+	}
+
+	c := &channelizerState{}
+	span := float64(hi-lo) + float64(proto.rateIn)
+	// the filter bank decimates by half, channels by 2
+	c.decim = (minimumRate / proto.rateIn) + 1
+	for c.decim%2 != 0 || float64(c.decim*proto.rateIn)*usableBandwidth < span {
+		c.decim++
+	}
+	c.rate = c.decim * proto.rateIn
+	if c.rate > maximumCaptureRate {
+		return nil, fmt.Errorf("Channels span %dHz, too wide for a single capture", hi-lo)
+	}
+	c.centre = captureCentre(freqs, lo, hi, c.rate, proto.rateIn)
+
+	c.bank = newFilterBank(c.decim)
+
+	for _, e := range s.entries {
+		if s.lockedOut(e) {
+			continue
+		}
+		offset := float64(e.freq) - float64(c.centre)
+		ch := &channel{
+			entry:   e,
+			demod:   proto.clone(),
+			bin:     c.bank.bin(offset / float64(c.rate)),
+			tuner:   newChannelTuner(offset, c.rate/c.bank.d),
+			in:      make(chan []complex128, 1),
+			out:     make(chan []int16, 1),
+			squelch: make(chan int, 1),
+		}
+		s.configure(ch.demod, e)
+		// output scale depends on the decimation, but the channelizer has
+		// already done it
+		ch.demod.downsample = c.decim
+		ch.demod.setOutputScale()
+		ch.demod.downsample = 1
+		c.channels = append(c.channels, ch)
+	}
+	c.setSquelch(s)
+
+	return c, nil
+}
+
+// Centre of the capture, nudged so the DC spike doesn't land on a channel
+func captureCentre(freqs []uint32, lo, hi uint32, rate, chanRate int) uint32 {
+	mid := (int(lo) + int(hi)) / 2
+	edge := int(float64(rate) * usableBandwidth / 2)
+
+	for k := 0; k < 16; k++ {
+		step := (k + 1) / 2 * chanRate / 4
+		if k%2 == 1 {
+			step = -step
+		}
+		centre := mid + step
+
+		ok := true
+		for _, f := range freqs {
+			off := int(f) - centre
+			if off < 0 {
+				off = -off
+			}
+			if off < chanRate/4 || off+chanRate/2 > edge {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return uint32(centre)
+		}
+	}
+	return uint32(mid)
+}
+
+// windowed sinc low-pass, cutoff as a fraction of the sample rate
+func firLowPass(n int, cutoff float64) []float64 {
+	taps := make([]float64, n)
+	var sum float64
+	m := float64(n-1) / 2
+	for i := range taps {
+		x := float64(i) - m
+		sinc := 2 * cutoff
+		if x != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		// Blackman
+		w := 0.42 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1)) +
+			0.08*math.Cos(4*math.Pi*float64(i)/float64(n-1))
+		taps[i] = sinc * w
+		sum += taps[i]
+	}
+	for i := range taps {
+		taps[i] /= sum
+	}
+	return taps
+}
+
+// Filter bank decimating by half of decim, even, for channels to halve
+//
+// Bins no more than a quarter of the bank rate apart leave room for a
+// channel anywhere between two of them. The prototype passes rateIn/2
+// either side of the furthest a channel can be from its bin and cuts off
+// at rateIn, half the bank rate.
+func newFilterBank(decim int) *filterBank {
+	d := decim / 2
+	m := 1
+	for m < 4*d {
+		m <<= 1
+	}
+	n := (tapsPerDecim*decim + m - 1) / m * m
+	// unity gain is scaled by decim to match lowPass
+	taps := firLowPass(n, 1/float64(decim))
+	for i := range taps {
+		taps[i] *= float64(decim)
+	}
+	return &filterBank{
+		m:      m,
+		d:      d,
+		taps:   taps,
+		hist:   make([]complex128, 2*n),
+		branch: make([]complex128, m),
+		plan:   newFftPlan(m),
+	}
+}
+
+// nearest bin to an offset from the centre, as a fraction of the input rate
+func (b *filterBank) bin(offset float64) int {
+	k := int(math.Floor(offset*float64(b.m) + 0.5))
+	return (k%b.m + b.m) % b.m
+}
+
+// Filter interleaved I/Q, returning the output of each of bins
+//
+// Every d samples the newest window of input is weighted by the prototype
+// and summed into m branches, one FFT of which gives every bin at once.
+func (b *filterBank) process(in []int16, bins []int) [][]complex128 {
+	n := len(b.taps)
+	out := make([][]complex128, len(bins))
+	for i := range out {
+		out[i] = make([]complex128, 0, len(in)/2/b.d+1)
+	}
+
+	for i := 0; i+1 < len(in); i += 2 {
+		b.pos--
+		if b.pos < 0 {
+			b.pos = n - 1
+		}
+		z := complex(float64(in[i]), float64(in[i+1]))
+		b.hist[b.pos], b.hist[b.pos+n] = z, z
+
+		b.count++
+		if b.count < b.d {
+			continue
+		}
+		b.count = 0
+
+		// newest sample first
+		h := b.hist[b.pos : b.pos+n]
+		for q := range b.branch {
+			b.branch[q] = 0
+		}
+		for p := 0; p < n; p += b.m {
+			for q, t := range b.taps[p : p+b.m] {
+				x := h[p+q]
+				b.branch[q] += complex(t*real(x), t*imag(x))
+			}
+		}
+		b.plan.transform(b.branch)
+
+		// the FFT runs the branches backwards in frequency
+		for i, k := range bins {
+			out[i] = append(out[i], b.branch[(b.m-k)%b.m])
+		}
+	}
+	return out
+}
+
+func newChannelTuner(offset float64, rate int) *channelTuner {
+	return &channelTuner{
+		phasor: 1,
+		rot:    cmplx.Exp(complex(0, -2*math.Pi*offset/float64(rate))),
+		taps:   firLowPass(channelTaps, 0.25),
+		hist:   make([]complex128, 2*channelTaps),
+	}
+}
+
+// Tune to the channel and decimate by 2, to interleaved I/Q
+func (t *channelTuner) process(in []complex128) []int16 {
+	n := len(t.taps)
+	out := make([]int16, 0, len(in)+2)
+
+	for _, z := range in {
+		z *= t.phasor
+		t.phasor *= t.rot
+
+		t.pos--
+		if t.pos < 0 {
+			t.pos = n - 1
+		}
+		t.hist[t.pos], t.hist[t.pos+n] = z, z
+
+		t.odd = !t.odd
+		if t.odd {
+			continue
+		}
+
+		var sum complex128
+		for k, x := range t.hist[t.pos : t.pos+n] {
+			sum += complex(t.taps[k]*real(x), t.taps[k]*imag(x))
+		}
+		out = append(out, clip16(real(sum)), clip16(imag(sum)))
+	}
+
+	// keep the NCO on the unit circle
+	t.phasor /= complex(cmplx.Abs(t.phasor), 0)
+
+	return out
+}
+
+// copy of the demodulator settings with fresh state
+func (d *demodState) clone() *demodState {
+	c := *d
+	c.lowpassed = nil
+	if d.nr != nil {
+		c.nr = newNoiseReducer()
+	}
+	if d.notch != nil {
+		c.notch = newAutoNotch()
+	}
+	if d.tone != nil {
+		c.tone = newToneDecoder(d.rateOut)
+	}
+	if d.activity != nil {
+		c.activity = newActivity(d.activity.log, d.activity.disc)
+	}
+	// already validated when d was set up
+	c.filters, _ = newFilterChain(d.filterSpec, d.audioRate())
+	c.agc.setup(c.rateOut)
+	return &c
+}
+
+func (ch *channel) run() {
+	// the channelizer did the decimation, levels are scaled to match
+	scale := demodState{downsample: channelizer.decim}
+	mode := controller.modeFor(ch.entry)
+
+	for buf := range ch.in {
+		select {
+		case level := <-ch.squelch:
+			ch.demod.squelchLevel = level
+		default:
+		}
+		ch.demod.lowpassed = ch.tuner.process(buf)
+		ch.demod.fullDemod()
+		if ch.demod.activity != nil {
+			ch.demod.activity.update(ch.demod.squelchOpen(), ch.entry, mode,
+				rmsToDb(ch.demod.signalLevel, dongle, &scale), ch.demod.tone)
+		}
+		if ch.rec != nil {
+			ch.rec.write(ch.demod.lowpassed, ch.entry, !ch.demod.squelched())
+		}
+		ch.out <- ch.demod.lowpassed
+	}
+	if ch.rec != nil {
+		ch.rec.close()
+	}
+	if ch.demod.activity != nil {
+		ch.demod.activity.finish()
+	}
+	close(ch.out)
+}
+
+// squelch depends on the decimation and RF gain. Each channel's demod
+// belongs to its goroutine, so the level is passed on, replacing any it
+// hasn't taken up yet.
+func (c *channelizerState) setSquelch(s *controllerState) {
+	proto := demodState{downsample: c.decim}
+	for _, ch := range c.channels {
+		select {
+		case <-ch.squelch:
+		default:
+		}
+		ch.squelch <- squelchToRms(s.squelchFor(ch.entry), dongle, &proto)
+	}
+}
+
+// takes the place of demodRoutine, feeding each capture to every channel
+// and mixing the results
+func channelizerRoutine(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for _, ch := range channelizer.channels {
+		go ch.run()
+	}
+
+	bins := make([]int, len(channelizer.channels))
+	for i, ch := range channelizer.channels {
+		bins[i] = ch.bin
+	}
+
+	for buf := range dongle.lpChan {
+		split := channelizer.bank.process(buf, bins)
+		for i, ch := range channelizer.channels {
+			ch.in <- split[i]
+		}
+
+		var mix []int32
+		for _, ch := range channelizer.channels {
+			audio := <-ch.out
+			for len(mix) < len(audio) {
+				mix = append(mix, 0)
+			}
+			for i, s := range audio {
+				mix[i] += int32(s)
+			}
+		}
+
+		result := make([]int16, len(mix))
+		for i, s := range mix {
+			result[i] = clip16(float64(s))
+		}
+		output.resultChan <- result
+	}
+
+	// wait for channels to finish, closing any recordings
+	for _, ch := range channelizer.channels {
+		close(ch.in)
+		for range ch.out {
+		}
+	}
+	close(output.resultChan)
+	close(controller.hopChan)
+	fmt.Fprintf(os.Stderr, "Returning from channelizerRoutine\n")
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+// interleaved I/Q of a tone at freq
+func channelTone(freq float64, rate, n int, amp float64) []int16 {
+	iq := make([]int16, 2*n)
+	for i := 0; i < n; i++ {
+		s, c := math.Sincos(2 * math.Pi * freq * float64(i) / float64(rate))
+		iq[2*i] = int16(math.Round(amp * c))
+		iq[2*i+1] = int16(math.Round(amp * s))
+	}
+	return iq
+}
+
+// amplitude of a tone at freq in interleaved I/Q, skipping the filters
+// settling, Hann windowed so other tones don't leak into it
+func toneAmplitude(iq []int16, freq float64, rate int) float64 {
+	iq = iq[len(iq)/4:]
+	n := len(iq) / 2
+	var sum complex128
+	var weight float64
+	for i := 0; i < n; i++ {
+		w := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n))
+		t := float64(i) / float64(rate)
+		sum += complex(w*float64(iq[2*i]), w*float64(iq[2*i+1])) * cmplx.Exp(complex(0, -2*math.Pi*freq*t))
+		weight += w
+	}
+	return cmplx.Abs(sum) / weight
+}
+
+func TestChannelizer(t *testing.T) {
+	const (
+		rateIn = 24000
+		decim  = 100
+		rate   = rateIn * decim
+		amp    = 40
+		// audio tone within the channel
+		tone = 1000
+	)
+	bank := newFilterBank(decim)
+	spacing := float64(rate) / float64(bank.m)
+
+	tests := []struct {
+		name   string
+		offset float64
+	}{
+		{"on a bin", 8 * spacing},
+		{"between bins", 8.5 * spacing},
+		{"below centre", -12.5e3 * 31},
+		{"near the edge", rate*usableBandwidth/2 - rateIn/2},
+	}
+	for _, tt := range tests {
+		// one channel, another 28kHz above and one at the same offset
+		// in the other half of the capture, the image of a bad mix
+		var capture []int16
+		for _, f := range []float64{tt.offset + tone, tt.offset + 28e3, -tt.offset} {
+			iq := channelTone(f, rate, rate/4, amp)
+			if capture == nil {
+				capture = iq
+				continue
+			}
+			for i := range capture {
+				capture[i] += iq[i]
+			}
+		}
+
+		b := newFilterBank(decim)
+		tuner := newChannelTuner(tt.offset, rate/b.d)
+		var out []int16
+		// in dongle sized blocks
+		for start := 0; start < len(capture); start += 2 * defaultBufLen {
+			end := start + 2*defaultBufLen
+			if end > len(capture) {
+				end = len(capture)
+			}
+			split := b.process(capture[start:end], []int{b.bin(tt.offset / rate)})
+			out = append(out, tuner.process(split[0])...)
+		}
+
+		if len(out) != len(capture)/decim {
+			t.Fatalf("%s: %d samples out of %d, want 1 in %d", tt.name, len(out), len(capture), decim)
+		}
+		// gain is decim, to match lowPass
+		gain := toneAmplitude(out, tone, rateIn) / amp / decim
+		if math.Abs(20*math.Log10(gain)) > 0.5 {
+			t.Errorf("%s: gain %.2fdB, want 0dB", tt.name, 20*math.Log10(gain))
+		}
+		for _, f := range []float64{28e3, -2 * tt.offset} {
+			leak := 20 * math.Log10(toneAmplitude(out, math.Remainder(f, rateIn), rateIn)/amp/decim+1e-12)
+			if leak > -60 {
+				t.Errorf("%s: tone %.0fHz away leaks through at %.1fdB", tt.name, f, leak)
+			}
+		}
+	}
+}
+
+func TestFilterBankBins(t *testing.T) {
+	b := newFilterBank(84)
+	if b.m < 4*b.d || b.m&(b.m-1) != 0 || len(b.taps)%b.m != 0 {
+		t.Fatalf("%d bins decimating by %d with %d taps", b.m, b.d, len(b.taps))
+	}
+	tests := []struct {
+		offset float64
+		bin    int
+	}{
+		{0, 0},
+		{1.4 / float64(b.m), 1},
+		{-1.0 / float64(b.m), b.m - 1},
+		{-0.5 + 0.1/float64(b.m), b.m / 2},
+	}
+	for _, tt := range tests {
+		if bin := b.bin(tt.offset); bin != tt.bin {
+			t.Errorf("offset %.4f: bin %d, want %d", tt.offset, bin, tt.bin)
+		}
+	}
+}
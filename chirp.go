@@ -0,0 +1,183 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CHIRP's CSV columns
+var chirpFields = []string{
+	"Location", "Name", "Frequency", "Duplex", "Offset", "Tone",
+	"rToneFreq", "cToneFreq", "DtcsCode", "DtcsPolarity", "CrossMode", "Mode",
+	"TStep", "Skip", "Comment", "URCALL", "RPT1CALL", "RPT2CALL",
+}
+
+// CHIRP mode to ours, with the bandwidth it implies
+var chirpModes = map[string]struct {
+	mode      string
+	bandwidth int
+}{
+	"FM":  {"fm", 0},
+	"NFM": {"fm", 12500},
+	"AM":  {"am", 0},
+	"WFM": {"wbfm", 0},
+}
+
+// a CSV row is from CHIRP if it has CHIRP's Location column
+func isChirpRow(row map[string]string) bool {
+	_, ok := row["location"]
+	return ok
+}
+
+// Convert a CHIRP CSV row to scan list columns, ok is false for
+// channels we can't receive e.g. D-STAR
+func chirpRow(row map[string]string) (out map[string]string, ok bool) {
+	m, ok := chirpModes[strings.ToUpper(row["mode"])]
+	if !ok {
+		return nil, false
+	}
+
+	out = map[string]string{
+		"label":  row["name"],
+		"mode":   m.mode,
+		"duplex": row["duplex"],
+	}
+	if m.bandwidth > 0 {
+		out["bandwidth"] = strconv.FormatFloat(float64(m.bandwidth)/1e3, 'f', -1, 64) + "k"
+	}
+	// CHIRP frequencies are MHz
+	if f := row["frequency"]; f != "" {
+		out["frequency"] = f + "M"
+	}
+	if f := row["offset"]; f != "" {
+		out["offset"] = f + "M"
+	}
+
+	// only the receive tone squelches, the transmit tone is kept for export
+	out["tonemode"] = row["tone"]
+	out["crossmode"] = row["crossmode"]
+	out["txtone"] = row["rtonefreq"]
+	switch row["tone"] {
+	case "TSQL":
+		out["tone"] = row["ctonefreq"]
+	case "Cross":
+		if strings.HasSuffix(row["crossmode"], "->Tone") {
+			out["tone"] = row["ctonefreq"]
+		}
+	default:
+		out["tone"] = ""
+	}
+
+	switch row["skip"] {
+	case "S":
+		out["lockout"] = "yes"
+	case "P":
+		out["priority"] = "yes"
+	}
+
+	return out, true
+}
+
+// Write entries as a CHIRP CSV. Entries without a mode get mode.
+func writeChirpCsv(name string, entries []*scanEntry, mode string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	err = w.Write(chirpFields)
+	if err != nil {
+		return err
+	}
+
+	for i, e := range entries {
+		m := e.mode
+		if m == "" {
+			m = mode
+		}
+		var chirpMode string
+		switch m {
+		case "am":
+			chirpMode = "AM"
+		case "wbfm":
+			chirpMode = "WFM"
+		default:
+			chirpMode = "FM"
+			if e.bandwidth > 0 && e.bandwidth <= 12500 {
+				chirpMode = "NFM"
+			}
+		}
+
+		toneMode := e.toneMode
+		if toneMode == "" && e.tone > 0 {
+			toneMode = "TSQL"
+		}
+		rTone, cTone := e.txTone, e.tone
+		if rTone == 0 {
+			rTone = cTone
+		}
+		if rTone == 0 {
+			rTone = 88.5
+		}
+		if cTone == 0 {
+			cTone = rTone
+		}
+		crossMode := e.crossMode
+		if crossMode == "" {
+			crossMode = "Tone->Tone"
+		}
+
+		var skip string
+		switch {
+		case e.lockout:
+			skip = "S"
+		case e.priority:
+			skip = "P"
+		}
+
+		err = w.Write([]string{
+			strconv.Itoa(i),
+			e.label,
+			fmt.Sprintf("%.6f", float64(e.freq)/1e6),
+			e.duplex,
+			fmt.Sprintf("%.6f", float64(e.offset)/1e6),
+			toneMode,
+			fmt.Sprintf("%.1f", rTone),
+			fmt.Sprintf("%.1f", cTone),
+			"023",
+			"NN",
+			crossMode,
+			chirpMode,
+			"5.00",
+			skip,
+			"", "", "", "",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChirpRow(t *testing.T) {
+	tests := []struct {
+		name string
+		row  map[string]string
+		want *scanEntry
+	}{
+		{"tone squelch", map[string]string{
+			"location": "1", "name": "Rpt", "frequency": "146.940000", "duplex": "-",
+			"offset": "0.600000", "tone": "TSQL", "rtonefreq": "88.5", "ctonefreq": "100.0", "mode": "FM",
+		}, &scanEntry{label: "Rpt", freq: 146940000, mode: "fm", duplex: "-", offset: 600000,
+			tone: 100, txTone: 88.5, toneMode: "TSQL"}},
+		{"transmit tone only", map[string]string{
+			"location": "2", "frequency": "147.000000", "tone": "Tone",
+			"rtonefreq": "123.0", "ctonefreq": "123.0", "mode": "NFM",
+		}, &scanEntry{freq: 147000000, mode: "fm", bandwidth: 12500, txTone: 123, toneMode: "Tone"}},
+		{"cross to tone", map[string]string{
+			"location": "3", "frequency": "147.000000", "tone": "Cross", "crossmode": "DTCS->Tone",
+			"rtonefreq": "88.5", "ctonefreq": "151.4", "mode": "FM",
+		}, &scanEntry{freq: 147000000, mode: "fm", tone: 151.4, txTone: 88.5, toneMode: "Cross", crossMode: "DTCS->Tone"}},
+		{"skipped", map[string]string{
+			"location": "4", "frequency": "121.500000", "mode": "AM", "skip": "S",
+		}, &scanEntry{freq: 121500000, mode: "am", lockout: true}},
+		{"priority", map[string]string{
+			"location": "5", "frequency": "98.100000", "mode": "WFM", "skip": "P",
+		}, &scanEntry{freq: 98100000, mode: "wbfm", priority: true}},
+	}
+	for _, tt := range tests {
+		if !isChirpRow(tt.row) {
+			t.Errorf("%s: not seen as CHIRP", tt.name)
+		}
+		row, ok := chirpRow(tt.row)
+		if !ok {
+			t.Errorf("%s: skipped", tt.name)
+			continue
+		}
+		e, err := parseScanEntry(row)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if *e != *tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *e, *tt.want)
+		}
+	}
+
+	for _, mode := range []string{"DV", "USB", "LSB", "CW"} {
+		if _, ok := chirpRow(map[string]string{"location": "1", "frequency": "145.5", "mode": mode}); ok {
+			t.Errorf("%s: not skipped", mode)
+		}
+	}
+	if isChirpRow(map[string]string{"frequency": "145.5M"}) {
+		t.Errorf("scan list row seen as CHIRP")
+	}
+}
+
+func TestChirpRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chirp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries := []*scanEntry{
+		{label: "Rpt", freq: 146940000, duplex: "-", offset: 600000, tone: 100, txTone: 88.5, toneMode: "TSQL"},
+		{label: "Narrow", freq: 446006250, mode: "fm", bandwidth: 12500, tone: 67},
+		{label: "Tower", freq: 118700000, mode: "am", lockout: true},
+		{freq: 98100000, mode: "wbfm", priority: true},
+		{label: "Cross", freq: 147000000, tone: 151.4, txTone: 88.5, toneMode: "Cross", crossMode: "DTCS->Tone"},
+		{label: "Cross off", freq: 147060000, txTone: 100, toneMode: "Cross", crossMode: "Tone->DTCS"},
+	}
+	name := filepath.Join(dir, "export.csv")
+	if err := writeChirpCsv(name, entries, "fm"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadScanList(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("%d entries read back, want %d", len(got), len(entries))
+	}
+	for i, want := range entries {
+		e := got[i]
+		if want.mode == "" {
+			want.mode = "fm"
+		}
+		if e.label != want.label || e.freq != want.freq || e.mode != want.mode ||
+			e.bandwidth != want.bandwidth || e.tone != want.tone ||
+			e.duplex != want.duplex || e.offset != want.offset ||
+			e.lockout != want.lockout || e.priority != want.priority {
+			t.Errorf("entry %d: read back %+v, want %+v", i, *e, *want)
+		}
+		// others pick up CHIRP's defaults
+		if want.toneMode == "Cross" && (e.txTone != want.txTone || e.toneMode != want.toneMode || e.crossMode != want.crossMode) {
+			t.Errorf("entry %d: read back %+v, want %+v", i, *e, *want)
+		}
+	}
+}
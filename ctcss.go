@@ -0,0 +1,126 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"math"
+)
+
+const (
+	// decision window, long enough to separate adjacent tones (2.3Hz)
+	toneWindow = 0.5
+	// fraction of the sub-audible power that must be in the tone
+	toneRatio = 0.5
+	// just above the highest tone, steep enough to keep voice out
+	toneCutoff = 260
+)
+
+// standard CTCSS tones, Hz
+var ctcssTones = []float64{
+	67.0, 69.3, 71.9, 74.4, 77.0, 79.7, 82.5, 85.4, 88.5, 91.5,
+	94.8, 97.4, 100.0, 103.5, 107.2, 110.9, 114.8, 118.8, 123.0, 127.3,
+	131.8, 136.5, 141.3, 146.2, 150.0, 151.4, 156.7, 159.8, 162.2, 165.5,
+	167.9, 171.3, 173.8, 177.3, 179.9, 183.5, 186.2, 189.9, 192.8, 196.6,
+	199.5, 203.5, 206.5, 210.7, 218.1, 225.7, 229.1, 233.6, 241.8, 250.3,
+	254.1,
+}
+
+// CTCSS decoder
+//
+// Audio is low-passed to the sub-audible band and a Goertzel filter for
+// each standard tone runs over a half second window. The strongest tone is
+// decoded if it carries most of the sub-audible power.
+type toneDecoder struct {
+	window int
+	lpf    []*biquad
+	coeff  []float64
+	s1, s2 []float64
+	n      int
+	total  float64
+
+	// last decoded tone, 0 for none
+	tone float64
+}
+
+func newToneDecoder(rate int) *toneDecoder {
+	t := &toneDecoder{
+		window: int(toneWindow * float64(rate)),
+		lpf:    butterworthSections(false, float64(rate), toneCutoff, 3),
+		coeff:  make([]float64, len(ctcssTones)),
+		s1:     make([]float64, len(ctcssTones)),
+		s2:     make([]float64, len(ctcssTones)),
+	}
+	for i, f := range ctcssTones {
+		t.coeff[i] = 2 * math.Cos(2*math.Pi*f/float64(rate))
+	}
+	return t
+}
+
+func (t *toneDecoder) process(buf []int16) {
+	for _, s := range buf {
+		x := float64(s)
+		for _, bq := range t.lpf {
+			x = bq.filter(x)
+		}
+		t.total += x * x
+
+		for i, c := range t.coeff {
+			s0 := x + c*t.s1[i] - t.s2[i]
+			t.s2[i] = t.s1[i]
+			t.s1[i] = s0
+		}
+
+		t.n++
+		if t.n == t.window {
+			t.decide()
+		}
+	}
+}
+
+func (t *toneDecoder) decide() {
+	best, bestPower := 0, 0.0
+	for i, c := range t.coeff {
+		p := t.s1[i]*t.s1[i] + t.s2[i]*t.s2[i] - c*t.s1[i]*t.s2[i]
+		if p > bestPower {
+			best, bestPower = i, p
+		}
+		t.s1[i], t.s2[i] = 0, 0
+	}
+
+	// power of a sinusoid from its Goertzel magnitude is 2|X|^2/N^2
+	t.tone = 0
+	if t.total > 0 && 2*bestPower/(float64(t.n)*t.total) > toneRatio {
+		t.tone = ctcssTones[best]
+	}
+	t.n = 0
+	t.total = 0
+}
+
+func (t *toneDecoder) matches(tone float64) bool {
+	return math.Abs(t.tone-tone) < 0.05
+}
+
+// nearest standard tone within 1Hz, 0 if there isn't one
+func nearestTone(f float64) float64 {
+	nearest := 0.0
+	for _, t := range ctcssTones {
+		if math.Abs(t-f) < 1 && (nearest == 0 || math.Abs(t-f) < math.Abs(nearest-f)) {
+			nearest = t
+		}
+	}
+	return nearest
+}
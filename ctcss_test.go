@@ -0,0 +1,86 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// a second of audio: a sub-audible tone under voice band tones and noise
+func toneAudio(rate int, tone, toneAmp float64) []int16 {
+	r := rand.New(rand.NewSource(1))
+	buf := make([]int16, rate)
+	for i := range buf {
+		t := float64(i) / float64(rate)
+		x := toneAmp*math.Sin(2*math.Pi*tone*t) +
+			3000*math.Sin(2*math.Pi*440*t) + 2000*math.Sin(2*math.Pi*1250*t) +
+			r.NormFloat64()*300
+		buf[i] = int16(x)
+	}
+	return buf
+}
+
+func TestToneDecoder(t *testing.T) {
+	tests := []struct {
+		name    string
+		tone    float64
+		toneAmp float64
+		want    float64
+	}{
+		{"lowest", 67.0, 500, 67.0},
+		{"common", 88.5, 500, 88.5},
+		{"2.3Hz from 69.3", 71.9, 500, 71.9},
+		{"1.4Hz from 150.0", 151.4, 500, 151.4},
+		{"highest", 254.1, 500, 254.1},
+		{"off standard", 100.4, 500, 100.0},
+		{"none", 0, 0, 0},
+		{"buried in noise", 123.0, 20, 0},
+	}
+	for _, tt := range tests {
+		for _, rate := range []int{8000, 24000} {
+			d := newToneDecoder(rate)
+			d.process(toneAudio(rate, tt.tone, tt.toneAmp))
+			if d.tone != tt.want {
+				t.Errorf("%s at %d: decoded %.1fHz, want %.1fHz", tt.name, rate, d.tone, tt.want)
+			}
+			if tt.want > 0 && !d.matches(tt.want) {
+				t.Errorf("%s at %d: doesn't match %.1fHz", tt.name, rate, tt.want)
+			}
+		}
+	}
+}
+
+func TestNearestTone(t *testing.T) {
+	tests := []struct {
+		in, want float64
+	}{
+		{88.5, 88.5},
+		{88, 88.5},
+		{150.6, 150.0},
+		{150.8, 151.4},
+		{250, 250.3},
+		{60, 0},
+		{300, 0},
+	}
+	for _, tt := range tests {
+		if got := nearestTone(tt.in); got != tt.want {
+			t.Errorf("nearestTone(%.1f) = %.1f, want %.1f", tt.in, got, tt.want)
+		}
+	}
+}
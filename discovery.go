@@ -0,0 +1,173 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var discoveryFields = []string{"label", "frequency", "mode", "hits", "duration", "last_heard", "peak_db", "heard_tone"}
+
+// a frequency where squelch has opened
+type discovered struct {
+	entry    *scanEntry
+	mode     string
+	hits     int
+	duration time.Duration
+	last     time.Time
+	peak     float64
+	tone     float64
+}
+
+// Discovery mode remembers every frequency where squelch opened and keeps
+// a scan list of them up to date in a file, YAML by .yaml/.yml extension
+// otherwise CSV as for -scan. Unknown columns are ignored by -scan so the
+// file can be used directly.
+type discovery struct {
+	mu    sync.Mutex
+	name  string
+	yaml  bool
+	found map[uint32]*discovered
+}
+
+var discoverer *discovery
+
+func newDiscovery(name string) *discovery {
+	ext := strings.ToLower(filepath.Ext(name))
+	return &discovery{
+		name:  name,
+		yaml:  ext == ".yaml" || ext == ".yml",
+		found: make(map[uint32]*discovered),
+	}
+}
+
+// called as each transmission ends, the file is rewritten so nothing is
+// lost if we're killed
+func (d *discovery) add(ev *activityEvent, e *scanEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, ok := d.found[ev.Freq]
+	if !ok {
+		f = &discovered{entry: e, peak: ev.PeakDb}
+		d.found[ev.Freq] = f
+		fmt.Fprintf(os.Stderr, "Discovered %s\n", e)
+	}
+	f.mode = ev.Mode
+	f.hits++
+	f.duration += ev.End.Sub(ev.Start)
+	f.last = ev.End
+	if ev.PeakDb > f.peak {
+		f.peak = ev.PeakDb
+	}
+	if ev.Tone > 0 {
+		f.tone = ev.Tone
+	}
+
+	err := d.write()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write %s: %s\n", d.name, err)
+	}
+}
+
+// discovered frequencies as scan list entries, lowest first
+func (d *discovery) entries() []*scanEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var entries []*scanEntry
+	for _, f := range d.sorted() {
+		e := *f.entry
+		e.mode = f.mode
+		entries = append(entries, &e)
+	}
+	return entries
+}
+
+func (d *discovery) sorted() []*discovered {
+	var found []*discovered
+	for _, f := range d.found {
+		found = append(found, f)
+	}
+	sort.Slice(found, func(a, b int) bool {
+		return found[a].entry.freq < found[b].entry.freq
+	})
+	return found
+}
+
+// the file is replaced each time
+func (d *discovery) write() error {
+	f, err := os.Create(d.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rows [][]string
+	for _, found := range d.sorted() {
+		var tone string
+		if found.tone > 0 {
+			tone = strconv.FormatFloat(found.tone, 'f', 1, 64)
+		}
+		rows = append(rows, []string{
+			found.entry.label,
+			strconv.FormatFloat(float64(found.entry.freq)/1e6, 'f', -1, 64) + "M",
+			found.mode,
+			strconv.Itoa(found.hits),
+			strconv.FormatFloat(found.duration.Seconds(), 'f', 1, 64),
+			found.last.Format(time.RFC3339),
+			strconv.FormatFloat(found.peak, 'f', 1, 64),
+			tone,
+		})
+	}
+
+	if d.yaml {
+		return writeYamlRows(f, rows)
+	}
+	w := csv.NewWriter(f)
+	w.Write(discoveryFields)
+	w.WriteAll(rows)
+	return w.Error()
+}
+
+// one mapping per row, empty values left out and strings quoted
+func writeYamlRows(f *os.File, rows [][]string) error {
+	w := bufio.NewWriter(f)
+	for _, row := range rows {
+		prefix := "- "
+		for i, v := range row {
+			if v == "" {
+				continue
+			}
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				v = strconv.Quote(v)
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, discoveryFields[i], v)
+			prefix = "  "
+		}
+	}
+	return w.Flush()
+}
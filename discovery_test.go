@@ -0,0 +1,68 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the discovery file can be scanned as written
+func TestDiscoveryScanList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2026, time.October, 17, 10, 15, 0, 0, time.UTC)
+	events := []struct {
+		ev *activityEvent
+		e  *scanEntry
+	}{
+		{&activityEvent{Start: start, End: start.Add(5 * time.Second), Freq: 146520000, Mode: "fm", PeakDb: 30, Tone: 88.5},
+			&scanEntry{freq: 146520000, label: "Calling: simplex"}},
+		{&activityEvent{Start: start, End: start.Add(2 * time.Second), Freq: 145500000, Mode: "fm", PeakDb: 20},
+			&scanEntry{freq: 145500000}},
+		{&activityEvent{Start: start.Add(time.Minute), End: start.Add(time.Minute + 3*time.Second), Freq: 146520000, Mode: "fm", PeakDb: 35},
+			&scanEntry{freq: 146520000, label: "Calling: simplex"}},
+	}
+
+	for _, name := range []string{"found.csv", "found.yaml", "found.yml", "found.txt"} {
+		d := newDiscovery(filepath.Join(dir, name))
+		for _, ev := range events {
+			d.add(ev.ev, ev.e)
+		}
+		f := d.found[146520000]
+		if f.hits != 2 || f.duration != 8*time.Second || f.peak != 35 || f.tone != 88.5 {
+			t.Errorf("%s: %+v", name, *f)
+		}
+
+		entries, err := loadScanList(d.name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if len(entries) != 2 || entries[0].freq != 145500000 || entries[1].freq != 146520000 ||
+			entries[1].label != "Calling: simplex" || entries[1].mode != "fm" {
+			t.Errorf("%s: read back %v", name, entries)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"math"
+)
+
+// in-place radix-2 FFT, len(x) must be a power of two
+func fft(x []complex128) {
+	newFftPlan(len(x)).transform(x)
+}
+
+// twiddle factors for repeated FFTs of one size
+type fftPlan struct {
+	twiddle []complex128
+}
+
+func newFftPlan(n int) *fftPlan {
+	p := &fftPlan{twiddle: make([]complex128, n/2)}
+	for k := range p.twiddle {
+		s, c := math.Sincos(-2 * math.Pi * float64(k) / float64(n))
+		p.twiddle[k] = complex(c, s)
+	}
+	return p
+}
+
+// in-place, len(x) must be the size the plan was made for
+func (p *fftPlan) transform(x []complex128) {
+	n := len(x)
+
+	// bit reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		half := size / 2
+		stride := n / size
+		for start := 0; start < n; start += size {
+			for k := 0; k < half; k++ {
+				a := x[start+k]
+				b := x[start+k+half] * p.twiddle[k*stride]
+				x[start+k] = a + b
+				x[start+k+half] = a - b
+			}
+		}
+	}
+}
+
+// inverse of transform, including the 1/n scaling
+func (p *fftPlan) inverse(x []complex128) {
+	for i := range x {
+		x[i] = complex(real(x[i]), -imag(x[i]))
+	}
+	p.transform(x)
+	scale := 1 / float64(len(x))
+	for i := range x {
+		x[i] = complex(real(x[i])*scale, -imag(x[i])*scale)
+	}
+}
+
+// periodic Hann window
+func hannWindow(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n))
+	}
+	return w
+}
+
+// averaged power spectrum of 8 bit I/Q from the dongle
+type spectrum struct {
+	window []float64
+	buf    []complex128
+	power  []float64
+	frames int
+}
+
+func newSpectrum(n int) *spectrum {
+	return &spectrum{
+		window: hannWindow(n),
+		buf:    make([]complex128, n),
+		power:  make([]float64, n),
+	}
+}
+
+// Add interleaved unsigned I/Q in whole frames, any remainder is dropped
+func (s *spectrum) addRaw(iq []byte) {
+	n := len(s.buf)
+	for start := 0; start+2*n <= len(iq); start += 2 * n {
+		for i := range s.buf {
+			re := float64(iq[start+2*i]) - 127.5
+			im := float64(iq[start+2*i+1]) - 127.5
+			s.buf[i] = complex(re*s.window[i], im*s.window[i])
+		}
+		fft(s.buf)
+		for i, x := range s.buf {
+			s.power[i] += real(x)*real(x) + imag(x)*imag(x)
+		}
+		s.frames++
+	}
+}
+
+// Average power of each bin in dB relative to a full scale tone, lowest
+// frequency first so the centre is bin n/2. Starts a new average.
+func (s *spectrum) db() []float64 {
+	n := len(s.power)
+	full := 127.5 * float64(n) / 2
+	out := make([]float64, n)
+	for i, p := range s.power {
+		if s.frames > 0 {
+			p /= float64(s.frames)
+		}
+		out[(i+n/2)%n] = 10 * math.Log10(p/(full*full)+1e-20)
+		s.power[i] = 0
+	}
+	s.frames = 0
+	return out
+}
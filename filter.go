@@ -0,0 +1,246 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// above the highest CTCSS tone (254.1Hz)
+	defaultHighPass = 300
+	defaultVoiceLow = 300
+	defaultVoiceHi  = 3000
+	defaultLowPass  = 5000
+)
+
+// Butterworth Q for each biquad section, indexed by number of sections
+var butterworthQ = [][]float64{
+	nil,
+	{0.7071},
+	{0.5412, 1.3066},
+	{0.5176, 0.7071, 1.9319},
+}
+
+// audio filter block, runs in place on demodulated audio
+type audioFilter interface {
+	process(buf []int16)
+}
+
+type filterChain []audioFilter
+
+func (c filterChain) process(buf []int16) {
+	for _, f := range c {
+		f.process(buf)
+	}
+}
+
+// used to parse multiple -af params, keyed by demodulation mode
+// with "" applying to any mode
+type filterSpecs map[string]string
+
+// second order IIR section, coefficients from the RBJ audio EQ cookbook
+type biquad struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+	x1, x2     float64
+	y1, y2     float64
+}
+
+func newBiquad(highPass bool, rate, cutoff, q float64) *biquad {
+	w0 := 2 * math.Pi * cutoff / rate
+	sin, cos := math.Sincos(w0)
+	alpha := sin / (2 * q)
+	a0 := 1 + alpha
+
+	bq := &biquad{
+		a1: -2 * cos / a0,
+		a2: (1 - alpha) / a0,
+	}
+	if highPass {
+		bq.b0 = (1 + cos) / 2 / a0
+		bq.b1 = -(1 + cos) / a0
+	} else {
+		bq.b0 = (1 - cos) / 2 / a0
+		bq.b1 = (1 - cos) / a0
+	}
+	bq.b2 = bq.b0
+	return bq
+}
+
+func (bq *biquad) filter(x float64) float64 {
+	y := bq.b0*x + bq.b1*bq.x1 + bq.b2*bq.x2 - bq.a1*bq.y1 - bq.a2*bq.y2
+	bq.x2 = bq.x1
+	bq.x1 = x
+	bq.y2 = bq.y1
+	bq.y1 = y
+	return y
+}
+
+func (bq *biquad) process(buf []int16) {
+	for i := range buf {
+		buf[i] = clip16(bq.filter(float64(buf[i])))
+	}
+}
+
+// Butterworth cascade of the given number of biquad sections
+func butterworth(highPass bool, rate, cutoff float64, sections int) filterChain {
+	var c filterChain
+	for _, bq := range butterworthSections(highPass, rate, cutoff, sections) {
+		c = append(c, bq)
+	}
+	return c
+}
+
+func butterworthSections(highPass bool, rate, cutoff float64, sections int) []*biquad {
+	var bqs []*biquad
+	for _, q := range butterworthQ[sections] {
+		bqs = append(bqs, newBiquad(highPass, rate, cutoff, q))
+	}
+	return bqs
+}
+
+// low-pass on interleaved I/Q, limits IF bandwidth
+type iqFilter struct {
+	i []*biquad
+	q []*biquad
+}
+
+// nil if bandwidth doesn't narrow the channel
+func newIQLowPass(rate, bandwidth int) *iqFilter {
+	if bandwidth <= 0 || bandwidth >= rate {
+		return nil
+	}
+	return &iqFilter{
+		i: butterworthSections(false, float64(rate), float64(bandwidth)/2, 2),
+		q: butterworthSections(false, float64(rate), float64(bandwidth)/2, 2),
+	}
+}
+
+func (f *iqFilter) process(buf []int16) {
+	for n := 0; n+1 < len(buf); n += 2 {
+		x, y := float64(buf[n]), float64(buf[n+1])
+		for k := range f.i {
+			x = f.i[k].filter(x)
+			y = f.q[k].filter(y)
+		}
+		buf[n], buf[n+1] = clip16(x), clip16(y)
+	}
+}
+
+// Build a filter chain from a comma separated spec e.g. "hpf,lpf:2400"
+//
+// hpf[:cutoff]    high-pass, removes CTCSS tones (default 300Hz)
+// lpf[:cutoff]    low-pass for data modes (default 5000Hz)
+// bpf[:low:high]  band-pass (default 300-3000Hz)
+// voice           band-pass 300-3000Hz
+//
+// cutoffs are in Hz
+func newFilterChain(spec string, rate int) (c filterChain, err error) {
+	if spec == "" {
+		return
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		bits := strings.Split(strings.TrimSpace(item), ":")
+		args := make([]float64, len(bits)-1)
+		for i, b := range bits[1:] {
+			args[i], err = strconv.ParseFloat(b, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Bad filter parameter '%s': %s", b, err)
+			}
+		}
+
+		var cutoffs []float64
+		switch bits[0] {
+		case "hpf":
+			cutoffs = filterArgs(args, defaultHighPass)
+			if len(cutoffs) == 1 {
+				c = append(c, butterworth(true, float64(rate), cutoffs[0], 3))
+			}
+		case "lpf":
+			cutoffs = filterArgs(args, defaultLowPass)
+			if len(cutoffs) == 1 {
+				c = append(c, butterworth(false, float64(rate), cutoffs[0], 3))
+			}
+		case "voice":
+			args = nil
+			fallthrough
+		case "bpf":
+			cutoffs = filterArgs(args, defaultVoiceLow, defaultVoiceHi)
+			if len(cutoffs) == 2 {
+				c = append(c, butterworth(true, float64(rate), cutoffs[0], 2))
+				c = append(c, butterworth(false, float64(rate), cutoffs[1], 2))
+			}
+		default:
+			return nil, fmt.Errorf("Unknown filter '%s'", bits[0])
+		}
+
+		if len(cutoffs) == 0 {
+			return nil, fmt.Errorf("Wrong number of parameters for filter '%s'", item)
+		}
+		for _, f := range cutoffs {
+			if f <= 0 || f >= float64(rate)/2 {
+				return nil, fmt.Errorf("Filter '%s' cutoff %.0fHz outside 0-%dHz", item, f, rate/2)
+			}
+		}
+	}
+
+	return
+}
+
+// args if given, otherwise defaults. nil if the count doesn't match
+func filterArgs(args []float64, defaults ...float64) []float64 {
+	if len(args) == 0 {
+		return defaults
+	}
+	if len(args) != len(defaults) {
+		return nil
+	}
+	return args
+}
+
+// spec for the given mode, falling back to the any mode spec
+func (f filterSpecs) forMode(mode string) string {
+	if spec, ok := f[mode]; ok {
+		return spec
+	}
+	return f[""]
+}
+
+func (f *filterSpecs) String() string {
+	return fmt.Sprintf("%v", *f)
+}
+
+// [mode=]filter[,filter...]
+func (f *filterSpecs) Set(val string) error {
+	var mode string
+	spec := val
+	if i := strings.Index(val, "="); i >= 0 {
+		mode = val[:i]
+		spec = val[i+1:]
+	}
+
+	if *f == nil {
+		*f = filterSpecs{}
+	}
+	(*f)[mode] = spec
+	return nil
+}
@@ -0,0 +1,698 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	flacBlockSize = 4096
+	// seek table entries, thinned out as the file grows
+	flacSeekPoints = 128
+	// initial seek point spacing
+	flacSeekInterval = 10 * time.Second
+	flacMaxFixed     = 4
+	flacMaxPartition = 8
+	flacMaxRice      = 14
+)
+
+type flacSeekPoint struct {
+	sample uint64
+	// from the first frame
+	offset uint64
+	size   uint16
+}
+
+// FLAC file, mono 16 bit
+//
+// Frames use the fixed predictors with partitioned Rice coding, and silence
+// from squelch costs a few bytes a block. The stream is variable block size
+// so that a file can be appended to after a short final block. STREAMINFO
+// and the seek table, which has room reserved, are fixed up periodically
+// and on close.
+type flacWriter struct {
+	f    *os.File
+	rate int
+	// samples per frame, but for the last
+	blockSize int
+
+	pending []int32
+	samples uint64
+	// file offsets of the seek table and the first frame, and where the next
+	// frame goes
+	seekStart, audioStart, offset int64
+	minFrame, maxFrame            int
+	minBlock, maxBlock            int
+	// nil when appending, the checksum of the earlier audio isn't known
+	md5 hash.Hash
+
+	points   []flacSeekPoint
+	interval uint64
+	synced   time.Time
+	frame    bitWriter
+}
+
+// Start a new file with tags as Vorbis comments, or continue an existing
+// one keeping its tags
+func newFlacWriter(f *os.File, rate int, tags []string) (*flacWriter, error) {
+	w := &flacWriter{
+		f:         f,
+		rate:      rate,
+		blockSize: flacBlockSize,
+		interval:  uint64(flacSeekInterval.Seconds() * float64(rate)),
+		synced:    time.Now(),
+	}
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if end > 0 {
+		err = w.resume(end)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
+	w.md5 = md5.New()
+	var h bytes.Buffer
+	h.WriteString("fLaC")
+	flacBlockHeader(&h, false, 0, 34)
+	h.Write(w.streamInfo())
+	w.seekStart = int64(h.Len()) + 4
+	flacBlockHeader(&h, false, 3, 18*flacSeekPoints)
+	h.Write(w.seekTable())
+
+	vc := flacComments(tags)
+	flacBlockHeader(&h, true, 4, len(vc))
+	h.Write(vc)
+
+	_, err = f.Write(h.Bytes())
+	w.audioStart = int64(h.Len())
+	w.offset = w.audioStart
+	return w, err
+}
+
+// VORBIS_COMMENT block body
+func flacComments(tags []string) []byte {
+	var vc bytes.Buffer
+	vendor := "hamsdr"
+	binary.Write(&vc, binary.LittleEndian, uint32(len(vendor)))
+	vc.WriteString(vendor)
+	binary.Write(&vc, binary.LittleEndian, uint32(len(tags)))
+	for _, t := range tags {
+		binary.Write(&vc, binary.LittleEndian, uint32(len(t)))
+		vc.WriteString(t)
+	}
+	return vc.Bytes()
+}
+
+func flacBlockHeader(b *bytes.Buffer, last bool, kind, length int) {
+	if last {
+		kind |= 0x80
+	}
+	b.Write([]byte{byte(kind), byte(length >> 16), byte(length >> 8), byte(length)})
+}
+
+// Read back the metadata of a file written earlier, end bytes long.
+// STREAMINFO is only as recent as the last sync, so the frames after the
+// last seek point are walked to find where the audio really ends, and
+// anything after the last complete frame, such as a frame cut short when
+// we were killed, is dropped.
+func (w *flacWriter) resume(end int64) error {
+	var magic [4]byte
+	_, err := w.f.ReadAt(magic[:], 0)
+	if err != nil || string(magic[:]) != "fLaC" {
+		return fmt.Errorf("existing file isn't a FLAC file")
+	}
+
+	pos := int64(4)
+	for last := false; !last; {
+		var h [4]byte
+		_, err = w.f.ReadAt(h[:], pos)
+		if err != nil {
+			return err
+		}
+		last = h[0]&0x80 != 0
+		length := int64(h[1])<<16 | int64(h[2])<<8 | int64(h[3])
+		body := make([]byte, length)
+		_, err = w.f.ReadAt(body, pos+4)
+		if err != nil {
+			return err
+		}
+
+		switch h[0] & 0x7f {
+		case 0:
+			w.minBlock = int(body[0])<<8 | int(body[1])
+			w.maxBlock = int(body[2])<<8 | int(body[3])
+			w.minFrame = int(body[4])<<16 | int(body[5])<<8 | int(body[6])
+			w.maxFrame = int(body[7])<<16 | int(body[8])<<8 | int(body[9])
+			v := binary.BigEndian.Uint64(body[10:])
+			if int(v>>44) != w.rate || (v>>41)&7 != 0 || (v>>36)&31 != 15 {
+				return fmt.Errorf("existing file isn't a FLAC file in the same format")
+			}
+		case 3:
+			if length != 18*flacSeekPoints {
+				return fmt.Errorf("existing FLAC file wasn't written by hamsdr")
+			}
+			w.seekStart = pos + 4
+			for i := 0; i < flacSeekPoints; i++ {
+				p := flacSeekPoint{
+					sample: binary.BigEndian.Uint64(body[18*i:]),
+					offset: binary.BigEndian.Uint64(body[18*i+8:]),
+					size:   binary.BigEndian.Uint16(body[18*i+16:]),
+				}
+				if p.sample == 1<<64-1 {
+					break
+				}
+				w.points = append(w.points, p)
+			}
+		}
+		pos += 4 + length
+	}
+	if w.seekStart == 0 {
+		return fmt.Errorf("existing FLAC file wasn't written by hamsdr")
+	}
+	w.audioStart = pos
+
+	// samples are numbered across the whole file
+	var sync [2]byte
+	_, err = w.f.ReadAt(sync[:], w.audioStart)
+	if err == nil && (sync[0] != 0xff || sync[1] != 0xf9) {
+		return fmt.Errorf("existing FLAC file has fixed size blocks, it can't be appended to")
+	}
+	if n := len(w.points); n >= 2 && w.points[n-1].sample-w.points[n-2].sample > w.interval {
+		w.interval = w.points[n-1].sample - w.points[n-2].sample
+	}
+
+	from := w.audioStart
+	w.samples = 0
+	if n := len(w.points); n > 0 {
+		from += int64(w.points[n-1].offset)
+		w.samples = w.points[n-1].sample
+	}
+	if from > end {
+		return fmt.Errorf("existing FLAC file is shorter than its seek table")
+	}
+	data := make([]byte, end-from)
+	_, err = w.f.ReadAt(data, from)
+	if err != nil {
+		return err
+	}
+	frames := w.walkFrames(data)
+	w.offset = from + int64(frames)
+	if w.offset < end {
+		fmt.Fprintf(os.Stderr, "Dropping %d bytes of incomplete audio from the end of %s\n", end-w.offset, w.f.Name())
+		err = w.f.Truncate(w.offset)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.f.Seek(w.offset, io.SeekStart)
+	return err
+}
+
+// Count the complete frames at the start of data, numbered from w.samples,
+// returning the bytes they take. A frame ends where the next one with the
+// following sample number starts, or at the end of data, and its CRC must
+// check.
+func (w *flacWriter) walkFrames(data []byte) int {
+	pos := 0
+	for pos < len(data) {
+		sample, size, n, ok := flacFrameHeader(data[pos:])
+		if !ok || sample != w.samples {
+			break
+		}
+		end := -1
+		for q := pos + n; q+1 < len(data); q++ {
+			if data[q] != 0xff || data[q+1] != 0xf9 {
+				continue
+			}
+			next, _, _, ok := flacFrameHeader(data[q:])
+			if ok && next == sample+uint64(size) && crc16(data[pos:q]) == 0 {
+				end = q
+				break
+			}
+		}
+		if end < 0 && crc16(data[pos:]) == 0 {
+			end = len(data)
+		}
+		if end < 0 {
+			break
+		}
+		if w.minFrame == 0 || end-pos < w.minFrame {
+			w.minFrame = end - pos
+		}
+		if end-pos > w.maxFrame {
+			w.maxFrame = end - pos
+		}
+		// the last frame is followed by what we append
+		w.block(size)
+		w.samples += uint64(size)
+		pos = end
+	}
+	return pos
+}
+
+// Parse a frame header as written by encodeFrame, giving the first sample
+// number, the block size and the header length
+func flacFrameHeader(b []byte) (sample uint64, size, n int, ok bool) {
+	if len(b) < 5 || b[0] != 0xff || b[1] != 0xf9 || b[2]&0x0f != 0 || b[3] != 0x08 {
+		return 0, 0, 0, false
+	}
+	// coded like UTF-8
+	ones := 0
+	for ones < 8 && b[4]&(0x80>>uint(ones)) != 0 {
+		ones++
+	}
+	if ones == 1 || ones > 7 {
+		return 0, 0, 0, false
+	}
+	n = 5
+	if ones == 0 {
+		sample = uint64(b[4])
+	} else {
+		sample = uint64(b[4] & (0x7f >> uint(ones)))
+		for i := 1; i < ones; i++ {
+			if len(b) <= n || b[n]&0xc0 != 0x80 {
+				return 0, 0, 0, false
+			}
+			sample = sample<<6 | uint64(b[n]&0x3f)
+			n++
+		}
+	}
+	switch b[2] >> 4 {
+	case 12:
+		size = flacBlockSize
+	case 7:
+		if len(b) < n+2 {
+			return 0, 0, 0, false
+		}
+		size = int(b[n])<<8 | int(b[n+1]) + 1
+		n += 2
+	default:
+		return 0, 0, 0, false
+	}
+	if len(b) <= n || crc8(b[:n]) != b[n] {
+		return 0, 0, 0, false
+	}
+	return sample, size, n + 1, true
+}
+
+// Note the size of a frame that isn't the last. STREAMINFO leaves out the
+// last, but a short one is followed by more audio once the file is appended to.
+func (w *flacWriter) block(size int) {
+	if w.minBlock == 0 || size < w.minBlock {
+		w.minBlock = size
+	}
+	if size > w.maxBlock {
+		w.maxBlock = size
+	}
+}
+
+func (w *flacWriter) streamInfo() []byte {
+	minBlock, maxBlock := w.minBlock, w.maxBlock
+	if maxBlock == 0 {
+		minBlock, maxBlock = w.blockSize, w.blockSize
+	}
+	// the least STREAMINFO can hold, though an appended file can have
+	// shorter frames
+	if minBlock < 16 {
+		minBlock = 16
+	}
+	if maxBlock < minBlock {
+		maxBlock = minBlock
+	}
+	b := make([]byte, 34)
+	binary.BigEndian.PutUint16(b[0:], uint16(minBlock))
+	binary.BigEndian.PutUint16(b[2:], uint16(maxBlock))
+	for i := 0; i < 3; i++ {
+		b[4+i] = byte(w.minFrame >> uint(16-8*i))
+		b[7+i] = byte(w.maxFrame >> uint(16-8*i))
+	}
+	// rate, mono, 16 bit, total samples
+	binary.BigEndian.PutUint64(b[10:], uint64(w.rate)<<44|15<<36|w.samples&(1<<36-1))
+	return b
+}
+
+func (w *flacWriter) seekTable() []byte {
+	b := make([]byte, 18*flacSeekPoints)
+	for i := 0; i < flacSeekPoints; i++ {
+		p := flacSeekPoint{sample: 1<<64 - 1}
+		if i < len(w.points) {
+			p = w.points[i]
+		}
+		binary.BigEndian.PutUint64(b[18*i:], p.sample)
+		binary.BigEndian.PutUint64(b[18*i+8:], p.offset)
+		binary.BigEndian.PutUint16(b[18*i+16:], p.size)
+	}
+	return b
+}
+
+func (w *flacWriter) write(buf []int16) error {
+	for _, s := range buf {
+		w.pending = append(w.pending, int32(s))
+	}
+	for len(w.pending) >= w.blockSize {
+		err := w.writeFrame(w.pending[:w.blockSize])
+		if err != nil {
+			return err
+		}
+		w.block(w.blockSize)
+		w.pending = append(w.pending[:0], w.pending[w.blockSize:]...)
+	}
+	if time.Since(w.synced) > wavSync {
+		return w.sync(false)
+	}
+	return nil
+}
+
+func (w *flacWriter) writeFrame(x []int32) error {
+	if n := len(w.points); n == 0 || w.samples >= w.points[n-1].sample+w.interval {
+		w.points = append(w.points, flacSeekPoint{
+			sample: w.samples,
+			offset: uint64(w.offset - w.audioStart),
+			size:   uint16(len(x)),
+		})
+		// keep every other point
+		if len(w.points) > flacSeekPoints {
+			for i := range w.points[:flacSeekPoints/2] {
+				w.points[i] = w.points[2*i]
+			}
+			w.points = w.points[:flacSeekPoints/2]
+			w.interval *= 2
+		}
+	}
+
+	data := w.encodeFrame(x)
+	n, err := w.f.Write(data)
+	w.offset += int64(n)
+	if err != nil {
+		return err
+	}
+	if w.minFrame == 0 || len(data) < w.minFrame {
+		w.minFrame = len(data)
+	}
+	if len(data) > w.maxFrame {
+		w.maxFrame = len(data)
+	}
+	if w.md5 != nil {
+		var b [2]byte
+		for _, s := range x {
+			binary.LittleEndian.PutUint16(b[:], uint16(s))
+			w.md5.Write(b[:])
+		}
+	}
+	w.samples += uint64(len(x))
+	return nil
+}
+
+// Update STREAMINFO and the seek table, with the checksum once finished
+func (w *flacWriter) sync(final bool) error {
+	w.synced = time.Now()
+	info := w.streamInfo()
+	if final && w.md5 != nil {
+		copy(info[18:], w.md5.Sum(nil))
+	}
+	_, err := w.f.WriteAt(info, 8)
+	if err == nil {
+		_, err = w.f.WriteAt(w.seekTable(), w.seekStart)
+	}
+	return err
+}
+
+func (w *flacWriter) close() error {
+	var err error
+	if len(w.pending) > 0 {
+		err = w.writeFrame(w.pending)
+		w.pending = w.pending[:0]
+	}
+	if err == nil {
+		err = w.sync(true)
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *flacWriter) encodeFrame(x []int32) []byte {
+	b := &w.frame
+	b.reset()
+
+	// variable block size, the header carries the first sample number
+	b.write(0xfff9, 16)
+	if len(x) == flacBlockSize {
+		b.write(12, 4)
+	} else {
+		b.write(7, 4)
+	}
+	// rate from STREAMINFO, mono, 16 bit
+	b.write(0, 4)
+	b.write(0, 4)
+	b.write(4, 3)
+	b.write(0, 1)
+	for _, c := range flacUtf8(w.samples) {
+		b.write(uint64(c), 8)
+	}
+	if len(x) != flacBlockSize {
+		b.write(uint64(len(x)-1), 16)
+	}
+	b.write(uint64(crc8(b.buf)), 8)
+
+	encodeSubframe(b, x)
+
+	b.align()
+	crc := crc16(b.buf)
+	b.write(uint64(crc), 16)
+	return b.buf
+}
+
+func encodeSubframe(b *bitWriter, x []int32) {
+	constant := true
+	for _, s := range x {
+		if s != x[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		b.write(0, 8)
+		b.write(uint64(x[0]), 16)
+		return
+	}
+
+	// the fixed predictor with the fewest bits
+	bestOrder := -1
+	bestBits := 16 * len(x)
+	var best []uint32
+	var bestPart int
+	var bestKs []int
+	for order := 0; order <= flacMaxFixed && order < len(x); order++ {
+		res := fixedResidual(x, order)
+		part, ks, bits := riceParams(res, len(x), order)
+		bits += 16 * order
+		if bits < bestBits {
+			bestOrder, bestBits, best, bestPart, bestKs = order, bits, res, part, ks
+		}
+	}
+
+	if bestOrder < 0 {
+		b.write(1<<1, 8)
+		for _, s := range x {
+			b.write(uint64(s), 16)
+		}
+		return
+	}
+
+	b.write(uint64(8|bestOrder)<<1, 8)
+	for _, s := range x[:bestOrder] {
+		b.write(uint64(s), 16)
+	}
+	// Rice with 4 bit parameters
+	b.write(0, 2)
+	b.write(uint64(bestPart), 4)
+	i := 0
+	for p, k := range bestKs {
+		size := len(x) >> uint(bestPart)
+		if p == 0 {
+			size -= bestOrder
+		}
+		b.write(uint64(k), 4)
+		for _, u := range best[i : i+size] {
+			b.unary(u >> uint(k))
+			b.write(uint64(u), uint(k))
+		}
+		i += size
+	}
+}
+
+// residuals of the fixed predictor, folded to unsigned
+func fixedResidual(x []int32, order int) []uint32 {
+	res := make([]uint32, 0, len(x)-order)
+	for i := order; i < len(x); i++ {
+		var r int32
+		switch order {
+		case 0:
+			r = x[i]
+		case 1:
+			r = x[i] - x[i-1]
+		case 2:
+			r = x[i] - 2*x[i-1] + x[i-2]
+		case 3:
+			r = x[i] - 3*x[i-1] + 3*x[i-2] - x[i-3]
+		case 4:
+			r = x[i] - 4*x[i-1] + 6*x[i-2] - 4*x[i-3] + x[i-4]
+		}
+		res = append(res, uint32(r<<1^r>>31))
+	}
+	return res
+}
+
+// Partition order and Rice parameter for each partition, and roughly how
+// many bits they take
+func riceParams(res []uint32, n, order int) (part int, ks []int, bits int) {
+	bits = -1
+	for p := 0; p <= flacMaxPartition; p++ {
+		size := n >> uint(p)
+		if n%(1<<uint(p)) != 0 || size <= order {
+			break
+		}
+		var pks []int
+		pbits := 6
+		i := 0
+		for j := 0; j < 1<<uint(p); j++ {
+			count := size
+			if j == 0 {
+				count -= order
+			}
+			var sum uint64
+			for _, u := range res[i : i+count] {
+				sum += uint64(u)
+			}
+			i += count
+
+			k, kbits := 0, -1
+			for t := 0; t <= flacMaxRice; t++ {
+				c := count*(t+1) + int(sum>>uint(t))
+				if kbits < 0 || c < kbits {
+					k, kbits = t, c
+				}
+			}
+			pks = append(pks, k)
+			pbits += 4 + kbits
+		}
+		if bits < 0 || pbits < bits {
+			part, ks, bits = p, pks, pbits
+		}
+	}
+	return part, ks, bits
+}
+
+// frame and sample numbers, coded like UTF-8 up to 36 bits
+func flacUtf8(v uint64) []byte {
+	if v < 0x80 {
+		return []byte{byte(v)}
+	}
+	n := 2
+	for n < 7 && v >= 1<<uint(5*n+1) {
+		n++
+	}
+	b := make([]byte, n)
+	for i := n - 1; i > 0; i-- {
+		b[i] = 0x80 | byte(v&0x3f)
+		v >>= 6
+	}
+	b[0] = byte(0xff<<uint(8-n)) | byte(v)
+	return b
+}
+
+func crc8(data []byte) byte {
+	var crc byte
+	for _, d := range data {
+		crc ^= d
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, d := range data {
+		crc ^= uint16(d) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// MSB first bit packing
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (b *bitWriter) reset() {
+	b.buf = b.buf[:0]
+	b.acc = 0
+	b.nbits = 0
+}
+
+// low n bits of v, n up to 32
+func (b *bitWriter) write(v uint64, n uint) {
+	b.acc = b.acc<<n | v&(1<<n-1)
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.nbits -= 8
+		b.buf = append(b.buf, byte(b.acc>>b.nbits))
+	}
+}
+
+// q zeros and a one
+func (b *bitWriter) unary(q uint32) {
+	for ; q >= 32; q -= 32 {
+		b.write(0, 32)
+	}
+	b.write(1, uint(q)+1)
+}
+
+func (b *bitWriter) align() {
+	if b.nbits > 0 {
+		b.write(0, 8-b.nbits)
+	}
+}
@@ -0,0 +1,484 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// MSB first bit reader
+type flacBits struct {
+	b   []byte
+	pos int
+}
+
+func (r *flacBits) bits(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint64(r.b[r.pos/8]>>uint(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *flacBits) signed(n int) int64 {
+	v := r.bits(n)
+	if v&(1<<uint(n-1)) != 0 {
+		return int64(v) - 1<<uint(n)
+	}
+	return int64(v)
+}
+
+func (r *flacBits) unary() uint64 {
+	var q uint64
+	for r.bits(1) == 0 {
+		q++
+	}
+	return q
+}
+
+type decodedFlac struct {
+	rate, total int
+	md5         []byte
+	// from STREAMINFO
+	minBlock, maxBlock, minFrame, maxFrame int
+	// sample, offset from the first frame
+	seek    [][2]uint64
+	tags    []string
+	samples []int16
+	// first sample of the frame at each offset
+	frames map[uint64]uint64
+	// samples and bytes in each frame
+	blocks, sizes []int
+}
+
+// Decode a file as written by flacWriter, independently of it
+func decodeFlac(data []byte) (*decodedFlac, error) {
+	d := &decodedFlac{frames: make(map[uint64]uint64)}
+	if len(data) < 4 || string(data[:4]) != "fLaC" {
+		return nil, fmt.Errorf("no fLaC marker")
+	}
+	pos := 4
+	for last := false; !last; {
+		last = data[pos]&0x80 != 0
+		l := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		body := data[pos+4 : pos+4+l]
+		switch data[pos] & 0x7f {
+		case 0:
+			v := binary.BigEndian.Uint64(body[10:])
+			if (v>>41)&7 != 0 || (v>>36)&31 != 15 {
+				return nil, fmt.Errorf("not mono 16 bit")
+			}
+			d.minBlock = int(binary.BigEndian.Uint16(body))
+			d.maxBlock = int(binary.BigEndian.Uint16(body[2:]))
+			d.minFrame = int(body[4])<<16 | int(body[5])<<8 | int(body[6])
+			d.maxFrame = int(body[7])<<16 | int(body[8])<<8 | int(body[9])
+			d.rate = int(v >> 44)
+			d.total = int(v & (1<<36 - 1))
+			d.md5 = body[18:34]
+		case 3:
+			for i := 0; i < l/18; i++ {
+				sample := binary.BigEndian.Uint64(body[18*i:])
+				if sample != 1<<64-1 {
+					d.seek = append(d.seek, [2]uint64{sample, binary.BigEndian.Uint64(body[18*i+8:])})
+				}
+			}
+		case 4:
+			p := 4 + int(binary.LittleEndian.Uint32(body))
+			n := int(binary.LittleEndian.Uint32(body[p:]))
+			p += 4
+			for i := 0; i < n; i++ {
+				cl := int(binary.LittleEndian.Uint32(body[p:]))
+				d.tags = append(d.tags, string(body[p+4:p+4+cl]))
+				p += 4 + cl
+			}
+		}
+		pos += 4 + l
+	}
+
+	audio := pos
+	for pos < len(data) {
+		r := &flacBits{b: data, pos: 8 * pos}
+		if r.bits(16) != 0xfff9 {
+			return nil, fmt.Errorf("no frame sync at %d", pos)
+		}
+		bsCode := r.bits(4)
+		if r.bits(4) != 0 || r.bits(4) != 0 || r.bits(3) != 4 || r.bits(1) != 0 {
+			return nil, fmt.Errorf("bad frame header at %d", pos)
+		}
+		num := r.bits(8)
+		if num >= 0x80 {
+			n := 0
+			for num&(0x80>>uint(n)) != 0 {
+				n++
+			}
+			num &= 0xff >> uint(n+1)
+			for i := 1; i < n; i++ {
+				num = num<<6 | r.bits(8)&0x3f
+			}
+		}
+		var bs int
+		switch bsCode {
+		case 12:
+			bs = 4096
+		case 7:
+			bs = int(r.bits(16)) + 1
+		default:
+			return nil, fmt.Errorf("block size code %d", bsCode)
+		}
+		if crc8(data[pos:r.pos/8]) != byte(r.bits(8)) {
+			return nil, fmt.Errorf("header CRC at %d", pos)
+		}
+		if num != uint64(len(d.samples)) {
+			return nil, fmt.Errorf("frame at %d starts at sample %d, want %d", pos, num, len(d.samples))
+		}
+		d.frames[uint64(pos-audio)] = num
+
+		if r.bits(1) != 0 {
+			return nil, fmt.Errorf("bad subframe at %d", pos)
+		}
+		kind := r.bits(6)
+		r.bits(1)
+		x := make([]int64, bs)
+		switch {
+		case kind == 0:
+			v := r.signed(16)
+			for i := range x {
+				x[i] = v
+			}
+		case kind == 1:
+			for i := range x {
+				x[i] = r.signed(16)
+			}
+		case kind >= 8 && kind <= 12:
+			order := int(kind - 8)
+			for i := 0; i < order; i++ {
+				x[i] = r.signed(16)
+			}
+			if r.bits(2) != 0 {
+				return nil, fmt.Errorf("residual coding at %d", pos)
+			}
+			part := int(r.bits(4))
+			i := order
+			for p := 0; p < 1<<uint(part); p++ {
+				k := int(r.bits(4))
+				count := bs >> uint(part)
+				if p == 0 {
+					count -= order
+				}
+				for j := 0; j < count; j++ {
+					u := r.unary()<<uint(k) | r.bits(k)
+					res := int64(u >> 1)
+					if u&1 != 0 {
+						res = -res - 1
+					}
+					var pred int64
+					switch order {
+					case 1:
+						pred = x[i-1]
+					case 2:
+						pred = 2*x[i-1] - x[i-2]
+					case 3:
+						pred = 3*x[i-1] - 3*x[i-2] + x[i-3]
+					case 4:
+						pred = 4*x[i-1] - 6*x[i-2] + 4*x[i-3] - x[i-4]
+					}
+					x[i] = pred + res
+					i++
+				}
+			}
+		default:
+			return nil, fmt.Errorf("subframe type %d at %d", kind, pos)
+		}
+		for r.pos%8 != 0 {
+			r.bits(1)
+		}
+		end := r.pos / 8
+		if crc16(data[pos:end]) != uint16(r.bits(16)) {
+			return nil, fmt.Errorf("frame CRC at %d", pos)
+		}
+		for _, v := range x {
+			d.samples = append(d.samples, int16(v))
+		}
+		d.blocks = append(d.blocks, bs)
+		d.sizes = append(d.sizes, end+2-pos)
+		pos = end + 2
+	}
+	return d, nil
+}
+
+// silence, a tone in noise, full scale noise and a loud swept tone
+func flacSignal(n int, seed int64) []int16 {
+	rnd := rand.New(rand.NewSource(seed))
+	s := make([]int16, n)
+	for i := range s {
+		switch (i / 7000) % 4 {
+		case 1:
+			s[i] = int16(8000*math.Sin(float64(i)*0.05) + rnd.NormFloat64()*300)
+		case 2:
+			s[i] = int16(rnd.Intn(65536) - 32768)
+		case 3:
+			s[i] = int16(20000 * math.Sin(float64(i)*0.3) * math.Sin(float64(i)*0.001))
+		}
+	}
+	return s
+}
+
+// write x in uneven blocks, as the demodulator does
+func flacWrite(t *testing.T, w audioWriter, x []int16) {
+	for i := 0; i < len(x); i += 3001 {
+		end := i + 3001
+		if end > len(x) {
+			end = len(x)
+		}
+		if err := w.write(x[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// decode name and check it holds want, with a checksum if fresh
+func flacCheck(t *testing.T, name string, want []int16, fresh bool) *decodedFlac {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := decodeFlac(data)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	if d.rate != 24000 || d.total != len(want) || len(d.samples) != len(want) {
+		t.Fatalf("%s: %d samples at %d, STREAMINFO says %d, want %d", name, len(d.samples), d.rate, d.total, len(want))
+	}
+	for i := range want {
+		if d.samples[i] != want[i] {
+			t.Fatalf("%s: sample %d is %d, want %d", name, i, d.samples[i], want[i])
+		}
+	}
+
+	var raw bytes.Buffer
+	binary.Write(&raw, binary.LittleEndian, want)
+	sum := md5.Sum(raw.Bytes())
+	if fresh && !bytes.Equal(sum[:], d.md5) {
+		t.Errorf("%s: MD5 %x, want %x", name, d.md5, sum)
+	}
+	// unknown once appended to
+	if !fresh && !bytes.Equal(d.md5, make([]byte, 16)) {
+		t.Errorf("%s: MD5 %x after appending, want none", name, d.md5)
+	}
+	for _, p := range d.seek {
+		if s, ok := d.frames[p[1]]; !ok || s != p[0] {
+			t.Errorf("%s: seek point for sample %d at %d isn't a frame", name, p[0], p[1])
+		}
+	}
+	// the last block may be shorter than the minimum
+	if d.minBlock < 16 || d.maxBlock < d.minBlock {
+		t.Errorf("%s: STREAMINFO blocks %d to %d", name, d.minBlock, d.maxBlock)
+	}
+	for i, bs := range d.blocks {
+		if bs > d.maxBlock || bs < d.minBlock && bs >= 16 && i < len(d.blocks)-1 {
+			t.Errorf("%s: frame %d has %d samples, STREAMINFO says %d to %d", name, i, bs, d.minBlock, d.maxBlock)
+		}
+		if d.sizes[i] < d.minFrame || d.sizes[i] > d.maxFrame {
+			t.Errorf("%s: frame %d is %d bytes, STREAMINFO says %d to %d", name, i, d.sizes[i], d.minFrame, d.maxFrame)
+		}
+	}
+	return d
+}
+
+func TestFlacRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		x    []int16
+	}{
+		{"signal", flacSignal(1234567, 1)},
+		{"short", []int16{1, 2, 3}},
+		{"one block", flacSignal(4096, 2)},
+		{"silence", make([]int16, 24000*60)},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.name+".flac")
+		w, err := openAudio(name, 24000, true, []string{"FREQUENCY=145500000", "MODE=fm"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		flacWrite(t, w, tt.x)
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+		d := flacCheck(t, name, tt.x, true)
+		if len(d.tags) != 2 || d.tags[0] != "FREQUENCY=145500000" {
+			t.Errorf("%s: tags %v", tt.name, d.tags)
+		}
+		if len(tt.x) > 24000*20 && len(d.seek) < 2 {
+			t.Errorf("%s: %d seek points", tt.name, len(d.seek))
+		}
+	}
+}
+
+func TestFlacAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "append.flac")
+
+	a, b := flacSignal(1234567, 1), flacSignal(50003, 2)
+	for _, x := range [][]int16{a, b} {
+		w, err := openAudio(name, 24000, true, []string{"MODE=fm"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		flacWrite(t, w, x)
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := flacCheck(t, name, append(append([]int16(nil), a...), b...), false)
+	if len(d.tags) != 1 {
+		t.Errorf("tags %v, want those of the first run", d.tags)
+	}
+	// the first run's short last block is now in the middle
+	if d.minBlock != len(a)%flacBlockSize || d.maxBlock != flacBlockSize {
+		t.Errorf("STREAMINFO blocks %d to %d, want %d to %d", d.minBlock, d.maxBlock, len(a)%flacBlockSize, flacBlockSize)
+	}
+
+	if _, err := openAudio(name, 48000, true, nil); err == nil {
+		t.Errorf("appended at a different rate")
+	}
+	other := filepath.Join(dir, "other.flac")
+	if err := ioutil.WriteFile(other, []byte("RIFF....WAVE"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openAudio(other, 24000, true, nil); err == nil {
+		t.Errorf("appended to a file that isn't FLAC")
+	}
+}
+
+// killed part way through a frame, long after the last sync
+func TestFlacResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, b := flacSignal(24000*30, 1), flacSignal(50003, 2)
+	tests := []struct {
+		name string
+		// samples written before the last sync
+		synced int
+		// bytes lost from the end
+		cut int
+	}{
+		{"part frame", 24000 * 20, 100},
+		{"never synced", 0, 100},
+		{"frame boundary", 24000 * 20, 0},
+		{"header only", 24000 * 20, -1},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.name+".flac")
+		out, err := openAudio(name, 24000, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := out.(*flacWriter)
+		flacWrite(t, w, a[:tt.synced])
+		if err := w.sync(false); err != nil {
+			t.Fatal(err)
+		}
+		flacWrite(t, w, a[tt.synced:])
+		w.f.Close()
+
+		// pending samples never reached the file
+		kept := len(a) / flacBlockSize * flacBlockSize
+		end := w.offset
+		switch {
+		case tt.cut > 0:
+			kept -= flacBlockSize
+			end -= int64(tt.cut)
+		case tt.cut < 0:
+			// the next frame's header made it, but nothing else
+			kept -= flacBlockSize
+			end -= int64(w.maxFrame) / 2
+		}
+		if err := os.Truncate(name, end); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err = openAudio(name, 24000, true, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		flacWrite(t, out, b)
+		if err := out.close(); err != nil {
+			t.Fatal(err)
+		}
+		d := flacCheck(t, name, append(append([]int16(nil), a[:kept]...), b...), false)
+		// every block but the one closing the file is full
+		if d.minBlock != flacBlockSize || d.maxBlock != flacBlockSize {
+			t.Errorf("%s: STREAMINFO blocks %d to %d, want %d", tt.name, d.minBlock, d.maxBlock, flacBlockSize)
+		}
+	}
+}
+
+func TestFlacFrameHeader(t *testing.T) {
+	w := &flacWriter{}
+	for _, tt := range []struct {
+		sample uint64
+		size   int
+	}{
+		{0, flacBlockSize},
+		{127, 100},
+		{128, flacBlockSize},
+		{1 << 20, 1},
+		{1<<36 - 1, flacBlockSize},
+	} {
+		w.samples = tt.sample
+		x := make([]int32, tt.size)
+		frame := w.encodeFrame(x)
+		sample, size, n, ok := flacFrameHeader(frame)
+		if !ok || sample != tt.sample || size != tt.size || n >= len(frame) {
+			t.Errorf("sample %d of %d: parsed %d of %d, ok %v", tt.sample, tt.size, sample, size, ok)
+		}
+		frame[1] ^= 1
+		if _, _, _, ok := flacFrameHeader(frame); ok {
+			t.Errorf("sample %d: fixed block size frame accepted", tt.sample)
+		}
+		frame[1] ^= 1
+		frame[4] ^= 1
+		if _, _, _, ok := flacFrameHeader(frame); ok {
+			t.Errorf("sample %d: bad CRC accepted", tt.sample)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSkip = 5 * time.Minute
+
+// locked out in the scan list or at runtime
+func (s *controllerState) lockedOut(e *scanEntry) bool {
+	return e.lockout || s.locked[e.freq]
+}
+
+// locked out, or skipped until some time after now
+func (s *controllerState) skipped(e *scanEntry, now time.Time) bool {
+	return s.lockedOut(e) || now.Before(e.skipUntil)
+}
+
+// Read the lockout file, one frequency per line. A missing file is fine,
+// it's created on the first lockout.
+func (s *controllerState) loadLockouts() error {
+	f, err := os.Open(s.lockoutFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Hz, as saved
+		freq, err := strconv.ParseUint(line, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s: bad frequency '%s'", s.lockoutFile, line)
+		}
+		s.locked[uint32(freq)] = true
+	}
+	return scanner.Err()
+}
+
+func (s *controllerState) saveLockouts() {
+	if s.lockoutFile == "" {
+		return
+	}
+
+	var freqs []int
+	for freq := range s.locked {
+		freqs = append(freqs, int(freq))
+	}
+	sort.Ints(freqs)
+
+	f, err := os.Create(s.lockoutFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save lockouts: %s\n", err)
+		return
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "# hamsdr locked out frequencies, Hz")
+	for _, freq := range freqs {
+		fmt.Fprintln(w, freq)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save lockouts: %s\n", err)
+	}
+}
+
+// Lock out or skip the current entry, returning the entry to go to next
+func (s *controllerState) skipCurrent(until time.Time) int {
+	e := s.entries[s.freqNow]
+	if until.IsZero() {
+		s.locked[e.freq] = true
+		s.saveLockouts()
+		fmt.Fprintf(os.Stderr, "Locked out %s\n", e)
+	} else {
+		e.skipUntil = until
+		fmt.Fprintf(os.Stderr, "Skipping %s until %s\n", e, until.Format("15:04:05"))
+	}
+
+	if s.prioReturn >= 0 {
+		next := s.prioReturn
+		s.prioReturn = -1
+		return next
+	}
+	return s.nextEntry(s.freqNow)
+}
+
+// Handle a command typed on stdin, returning the entry to go to, or -1 to
+// stay put
+//
+//	l          lock out the current channel
+//	s [mins]   skip the current channel for a while
+//	u          clear runtime lockouts and skips, not those in the scan list
+func (s *controllerState) command(line string) int {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return -1
+	}
+	if channelizer != nil {
+		fmt.Fprintln(os.Stderr, "Channels can't be locked out at runtime with -multi")
+		return -1
+	}
+
+	switch fields[0] {
+	case "l", "lockout":
+		return s.skipCurrent(time.Time{})
+	case "s", "skip":
+		skip := defaultSkip
+		if len(fields) > 1 {
+			mins, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil || mins <= 0 {
+				fmt.Fprintf(os.Stderr, "Bad skip time '%s'\n", fields[1])
+				return -1
+			}
+			skip = time.Duration(mins * float64(time.Minute))
+		}
+		return s.skipCurrent(time.Now().Add(skip))
+	case "u", "unlock":
+		s.locked = make(map[uint32]bool)
+		for _, e := range s.entries {
+			e.skipUntil = time.Time{}
+		}
+		s.saveLockouts()
+		fmt.Fprintln(os.Stderr, "Cleared all lockouts and skips")
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%s', expected l(ockout), s(kip) [minutes] or u(nlock)\n", fields[0])
+	}
+	return -1
+}
+
+// reads commands from stdin for the controller
+func commandRoutine() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		controller.cmdChan <- scanner.Text()
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func lockoutEntries() []*scanEntry {
+	return []*scanEntry{
+		{freq: 145500000},
+		// locked out in the scan list
+		{freq: 146520000, lockout: true},
+		{freq: 147000000},
+		{freq: 147500000},
+	}
+}
+
+func TestLockoutCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "lockouts.txt")
+
+	s := &controllerState{
+		entries:     lockoutEntries(),
+		lockoutFile: file,
+		locked:      make(map[uint32]bool),
+		prioReturn:  -1,
+	}
+	now := time.Now()
+	tests := []struct {
+		cmd string
+		// on entry
+		at int
+		// entry to go to, -1 to stay
+		next int
+		// entries to be scanned afterwards
+		scanned []bool
+	}{
+		{"l", 0, 2, []bool{false, false, true, true}},
+		{"s 10", 2, 3, []bool{false, false, false, true}},
+		{"x", 3, -1, []bool{false, false, false, true}},
+		{"u", 3, -1, []bool{true, false, true, true}},
+		{"lockout", 3, 0, []bool{true, false, true, false}},
+	}
+	for _, tt := range tests {
+		s.freqNow = tt.at
+		if next := s.command(tt.cmd); next != tt.next {
+			t.Errorf("%s: going to %d, want %d", tt.cmd, next, tt.next)
+		}
+		for i, e := range s.entries {
+			if s.skipped(e, now) == tt.scanned[i] {
+				t.Errorf("%s: entry %d scanned %v, want %v", tt.cmd, i, !tt.scanned[i], tt.scanned[i])
+			}
+		}
+		if !s.entries[1].lockout {
+			t.Errorf("%s: scan list lockout cleared", tt.cmd)
+		}
+	}
+
+	// only the runtime lockout is kept for the next run
+	next := &controllerState{entries: lockoutEntries(), lockoutFile: file, locked: make(map[uint32]bool)}
+	if err := next.loadLockouts(); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.locked) != 1 || !next.locked[147500000] {
+		t.Errorf("loaded lockouts %v, want 147500000", next.locked)
+	}
+	if next.nextEntry(-1) != 0 || next.nextEntry(2) != 0 {
+		t.Errorf("next entries %d and %d, want 0", next.nextEntry(-1), next.nextEntry(2))
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+const (
+	nrFrameLen = 256
+	nrHopLen   = nrFrameLen / 2
+	// over-subtraction factor, compensates for the minimum tracker
+	// sitting below the mean noise power
+	nrAlpha = 3.0
+	// gain floor (-20dB), limits musical noise
+	nrFloor = 0.1
+	// per frame rise of the noise estimate, approx 10s time constant at 24k
+	nrRise = 0.0005
+
+	anTaps  = 64
+	anDelay = 16
+	anMu    = 0.005
+	anLeak  = 1e-5
+)
+
+// spectral subtraction noise reducer
+//
+// Audio is split into 50% overlapping frames, each frame's power spectrum is
+// compared against a running estimate of the noise floor and bins close to
+// the floor are attenuated. Output is delayed by one frame.
+type noiseReducer struct {
+	window  []float64
+	pending []float64
+	olap    []float64
+	ready   []int16
+	frame   []complex128
+	power   []float64
+	noise   []float64
+	gain    []float64
+	plan    *fftPlan
+}
+
+func newNoiseReducer() *noiseReducer {
+	nr := &noiseReducer{}
+	// sqrt Hann on analysis and synthesis sums to unity at 50% overlap
+	nr.window = hannWindow(nrFrameLen)
+	for i := range nr.window {
+		nr.window[i] = math.Sqrt(nr.window[i])
+	}
+	nr.olap = make([]float64, nrFrameLen)
+	nr.ready = make([]int16, nrFrameLen)
+	nr.frame = make([]complex128, nrFrameLen)
+	nr.power = make([]float64, nrFrameLen/2+1)
+	nr.noise = make([]float64, nrFrameLen/2+1)
+	nr.gain = make([]float64, nrFrameLen/2+1)
+	nr.plan = newFftPlan(nrFrameLen)
+	for i := range nr.noise {
+		nr.noise[i] = -1
+		nr.gain[i] = 1
+	}
+	return nr
+}
+
+func (nr *noiseReducer) process(buf []int16) {
+	for _, s := range buf {
+		nr.pending = append(nr.pending, float64(s))
+	}
+
+	for len(nr.pending) >= nrFrameLen {
+		nr.processFrame(nr.pending[:nrFrameLen])
+
+		for i := 0; i < nrHopLen; i++ {
+			nr.ready = append(nr.ready, clip16(nr.olap[i]))
+		}
+		copy(nr.olap, nr.olap[nrHopLen:])
+		for i := nrFrameLen - nrHopLen; i < nrFrameLen; i++ {
+			nr.olap[i] = 0
+		}
+		nr.pending = nr.pending[:copy(nr.pending, nr.pending[nrHopLen:])]
+	}
+
+	n := copy(buf, nr.ready)
+	nr.ready = nr.ready[:copy(nr.ready, nr.ready[n:])]
+}
+
+func (nr *noiseReducer) processFrame(in []float64) {
+	for i, s := range in {
+		nr.frame[i] = complex(s*nr.window[i], 0)
+	}
+	nr.plan.transform(nr.frame)
+
+	half := nrFrameLen / 2
+	for k := 0; k <= half; k++ {
+		p := real(nr.frame[k])*real(nr.frame[k]) + imag(nr.frame[k])*imag(nr.frame[k])
+		nr.power[k] = 0.7*nr.power[k] + 0.3*p
+
+		// minimum tracker: follow drops immediately, rise slowly
+		switch {
+		case nr.noise[k] < 0 || nr.power[k] < nr.noise[k]:
+			nr.noise[k] = nr.power[k]
+		default:
+			nr.noise[k] += (nr.power[k] - nr.noise[k]) * nrRise
+		}
+
+		g := nrFloor
+		if nr.power[k] > 0 {
+			if snr := 1 - nrAlpha*nr.noise[k]/nr.power[k]; snr > 0 {
+				g = math.Max(math.Sqrt(snr), nrFloor)
+			}
+		}
+		nr.gain[k] = 0.5*nr.gain[k] + 0.5*g
+
+		nr.frame[k] *= complex(nr.gain[k], 0)
+		if k > 0 && k < half {
+			nr.frame[nrFrameLen-k] = cmplx.Conj(nr.frame[k])
+		}
+	}
+	nr.plan.inverse(nr.frame)
+
+	for i := range nr.olap {
+		nr.olap[i] += real(nr.frame[i]) * nr.window[i]
+	}
+}
+
+// automatic notch, an adaptive line enhancer
+//
+// A normalised LMS filter predicts each sample from samples anDelay in the
+// past. Speech and noise decorrelate over that delay but steady carriers do
+// not, so the prediction contains only the tones and subtracting it leaves
+// everything else.
+type autoNotch struct {
+	hist []float64
+	pos  int
+	w    []float64
+}
+
+func newAutoNotch() *autoNotch {
+	return &autoNotch{
+		hist: make([]float64, anTaps+anDelay),
+		w:    make([]float64, anTaps),
+	}
+}
+
+func (an *autoNotch) process(buf []int16) {
+	size := len(an.hist)
+	for i, s := range buf {
+		x := float64(s) / (1 << 15)
+
+		var y, pow float64
+		for k := range an.w {
+			r := an.hist[(an.pos-anDelay-k+2*size)%size]
+			y += an.w[k] * r
+			pow += r * r
+		}
+		e := x - y
+
+		mu := anMu / (pow + 1e-6)
+		for k := range an.w {
+			r := an.hist[(an.pos-anDelay-k+2*size)%size]
+			an.w[k] = an.w[k]*(1-anLeak) + mu*e*r
+		}
+
+		an.hist[an.pos] = x
+		an.pos = (an.pos + 1) % size
+
+		buf[i] = clip16(e * (1 << 15))
+	}
+}
+
+func clip16(x float64) int16 {
+	if x >= (1 << 15) {
+		return (1 << 15) - 1
+	}
+	if x < -(1 << 15) {
+		return -(1 << 15) + 1
+	}
+	return int16(x)
+}
@@ -0,0 +1,237 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	rtl "github.com/jpoirier/gortlsdr"
+)
+
+const (
+	// bytes of I/Q read per hop per sweep, a multiple of 512 for ReadSync
+	powerReadLen = 1 << 18
+	powerMaxBins = 1 << 16
+)
+
+// one hardware bandwidth step of the sweep
+type powerHop struct {
+	centre uint32
+	// output bins, lowest first, from the FFT
+	low   uint32
+	first int
+	count int
+	spec  *spectrum
+}
+
+// hamsdr power, a wideband survey in the style of rtl_power
+//
+// The range is swept in steps of the capture bandwidth, less the cropped
+// edges. Spectra are averaged over each interval and written as CSV rows of
+// date, time, Hz low, Hz high, Hz step, samples, dB...
+func powerMain(args []string) {
+	fs := flag.NewFlagSet("power", flag.ExitOnError)
+	devIndex := fs.Int("d", 0, "dongle device index")
+	freqRange := fs.String("f", "", "lower:upper:bin_size e.g. 88M:108M:10k")
+	interval := fs.Duration("i", 10*time.Second, "integration interval")
+	exitAfter := fs.Duration("e", 0, "stop after this long, 0 to run until interrupted")
+	single := fs.Bool("1", false, "single interval then exit")
+	gain := fs.Int("g", autoGain, "gain level (defaults to autogain)")
+	ppmError := fs.Int("p", 0, "ppm error")
+	crop := fs.Float64("c", 0.2, "fraction of each hop discarded at the edges")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s power -f lower:upper:bin_size [options] [file]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	bits := strings.Split(*freqRange, ":")
+	if len(bits) != 3 {
+		fs.Usage()
+		return
+	}
+	var lower, upper, binSize uint32
+	var err error
+	lower, err = freqHz(bits[0])
+	if err == nil {
+		upper, err = freqHz(bits[1])
+	}
+	if err == nil {
+		binSize, err = freqHz(bits[2])
+	}
+	if err != nil || upper <= lower || binSize == 0 {
+		fmt.Fprintf(os.Stderr, "Bad frequency range '%s'\n", *freqRange)
+		return
+	}
+	if *crop < 0 || *crop >= 1 {
+		fmt.Fprintf(os.Stderr, "Crop must be between 0 and 1\n")
+		return
+	}
+
+	rate := maximumCaptureRate
+	n := 1
+	for n < rate/int(binSize) {
+		n <<= 1
+	}
+	if n > powerMaxBins {
+		fmt.Fprintf(os.Stderr, "Bin size %dHz is too small, minimum %dHz\n", binSize, rate/powerMaxBins)
+		return
+	}
+	binHz := float64(rate) / float64(n)
+	hopBins := int(float64(n) * (1 - *crop))
+	hopWidth := float64(hopBins) * binHz
+
+	var hops []*powerHop
+	for low := float64(lower); low < float64(upper); low += hopWidth {
+		h := &powerHop{
+			centre: uint32(low + hopWidth/2),
+			low:    uint32(low),
+			first:  (n - hopBins) / 2,
+			count:  hopBins,
+			spec:   newSpectrum(n),
+		}
+		if over := low + hopWidth - float64(upper); over > 0 {
+			h.count -= int(over / binHz)
+		}
+		hops = append(hops, h)
+	}
+	fmt.Fprintf(os.Stderr, "Sweeping %d hops of %.0fHz, %d bins of %.2fHz\n", len(hops), hopWidth, hopBins, binHz)
+
+	out := os.Stdout
+	if fs.Arg(0) != "" {
+		out, err = os.Create(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		defer out.Close()
+	}
+
+	dev, err := rtl.Open(*devIndex)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open dongle, '%s', exiting\n", err)
+		return
+	}
+	defer dev.Close()
+
+	err = dev.SetSampleRate(rate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting sample rate %d\n", rate)
+		return
+	}
+	if *gain == autoGain {
+		err = dev.SetTunerGainMode(false)
+	} else {
+		var g int
+		g, err = nearestGain(dev, *gain*10)
+		if err == nil {
+			err = dev.SetTunerGain(g)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting tuner gain: %s\n", err)
+		return
+	}
+	if *ppmError != 0 {
+		err = dev.SetFreqCorrection(*ppmError)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting frequency correction to %d: %s\n", *ppmError, err)
+			return
+		}
+	}
+	err = dev.ResetBuffer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+
+	w := bufio.NewWriter(out)
+	buf := make([]byte, powerReadLen)
+	var stop <-chan time.Time
+	if *exitAfter > 0 {
+		stop = time.After(*exitAfter)
+	}
+
+	done := false
+	for !done {
+		start := time.Now()
+		for !done && time.Since(start) < *interval {
+			for _, h := range hops {
+				err = dev.SetCenterFreq(int(h.centre))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error setting frequency %d\n", h.centre)
+					return
+				}
+				// the first read after retuning is from before it settled
+				for i := 0; i < 2; i++ {
+					_, err = dev.ReadSync(buf, powerReadLen)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "ReadSync failed, err %s\n", err)
+						return
+					}
+				}
+				h.spec.addRaw(buf)
+			}
+			select {
+			case <-signalChan:
+				fmt.Fprintln(os.Stderr, "\nReceived an interrupt, stopping")
+				done = true
+			case <-stop:
+				done = true
+			default:
+			}
+			if *single {
+				done = true
+			}
+		}
+
+		for _, h := range hops {
+			h.write(w, start, binHz)
+		}
+		err = w.Flush()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+}
+
+// one CSV row of the hop's averaged spectrum
+func (h *powerHop) write(w *bufio.Writer, t time.Time, binHz float64) {
+	samples := h.spec.frames * len(h.spec.buf)
+	db := h.spec.db()
+
+	// the DC spike isn't a signal
+	mid := len(db) / 2
+	db[mid] = (db[mid-1] + db[mid+1]) / 2
+
+	fmt.Fprintf(w, "%s, %s, %d, %d, %.2f, %d", t.Format("2006-01-02"), t.Format("15:04:05"),
+		h.low, h.low+uint32(float64(h.count)*binHz), binHz, samples)
+	for _, v := range db[h.first : h.first+h.count] {
+		fmt.Fprintf(w, ", %.2f", v)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Records audio while squelch is open, from one channel with -multi or
+// whichever channel the scanner stopped on
+//
+// With perTransmission set every squelch opening gets a new file, in a
+// directory for the day it started, otherwise each channel appends to a
+// single file. Transmissions shorter than minDuration are dropped.
+type recorder struct {
+	dir             string
+	perTransmission bool
+	rate            int
+	minDuration     time.Duration
+
+	entry *scanEntry
+	out   audioWriter
+	// held until the transmission is long enough to keep
+	pending []int16
+	start   time.Time
+	// the file couldn't be opened, the rest of the transmission is dropped
+	failed bool
+}
+
+func newRecorder(dir string, perTransmission bool, rate int, minDuration time.Duration) *recorder {
+	return &recorder{
+		dir:             dir,
+		perTransmission: perTransmission,
+		rate:            rate,
+		minDuration:     minDuration,
+	}
+}
+
+// e.g. 145.500MHz
+func freqLabel(freq uint32) string {
+	return fmt.Sprintf("%.3fMHz", float64(freq)/1e6)
+}
+
+// label made safe for a file name
+func fileLabel(label string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, label)
+}
+
+// file for a recording of e starting at t
+func (r *recorder) name(e *scanEntry, t time.Time) string {
+	name := freqLabel(e.freq)
+	if e.label != "" {
+		name += "_" + fileLabel(e.label)
+	}
+	name += "." + recordFormat
+	if !r.perTransmission {
+		return filepath.Join(r.dir, name)
+	}
+	return filepath.Join(r.dir, t.Format("2006-01-02"), t.Format("20060102T150405")+"_"+name)
+}
+
+// Record buf heard on e, finishing the recording when squelch closes or the
+// channel changes
+func (r *recorder) write(buf []int16, e *scanEntry, open bool) {
+	if !open || e != r.entry {
+		r.close()
+	}
+	if !open {
+		return
+	}
+	r.entry = e
+	if r.failed {
+		return
+	}
+
+	if r.out == nil {
+		if r.pending == nil {
+			r.start = time.Now()
+		}
+		r.pending = append(r.pending, buf...)
+		if time.Duration(len(r.pending))*time.Second < r.minDuration*time.Duration(r.rate) {
+			return
+		}
+
+		name := r.name(e, r.start)
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err == nil {
+			r.out, err = openAudio(name, r.rate, true, audioTags(e, controller.modeFor(e), r.start))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening recording: %s\n", err)
+			r.out = nil
+			r.pending = nil
+			r.failed = true
+			return
+		}
+		buf = r.pending
+		r.pending = nil
+	}
+
+	err := r.out.write(buf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "recording write error: %s\n", err)
+	}
+}
+
+func (r *recorder) close() {
+	r.entry = nil
+	r.pending = nil
+	r.failed = false
+	if r.out == nil {
+		return
+	}
+	err := r.out.close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing recording: %s\n", err)
+	}
+	r.out = nil
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRecorderName(t *testing.T) {
+	defer func(f string) { recordFormat = f }(recordFormat)
+	start := time.Date(2026, time.October, 17, 9, 5, 3, 0, time.Local)
+	tests := []struct {
+		perTransmission bool
+		format          string
+		e               *scanEntry
+		want            string
+	}{
+		{true, "wav", &scanEntry{freq: 145500000, label: "Simplex"},
+			"rec/2026-10-17/20261017T090503_145.500MHz_Simplex.wav"},
+		{true, "flac", &scanEntry{freq: 446006250},
+			"rec/2026-10-17/20261017T090503_446.006MHz.flac"},
+		{true, "raw", &scanEntry{freq: 146940000, label: "GB3XX/R: Rpt 1"},
+			"rec/2026-10-17/20261017T090503_146.940MHz_GB3XX_R__Rpt_1.raw"},
+		{false, "wav", &scanEntry{freq: 145500000, label: "Simplex"},
+			"rec/145.500MHz_Simplex.wav"},
+		{false, "raw", &scanEntry{freq: 118700000, label: "Tower ../../etc"},
+			"rec/118.700MHz_Tower_.._.._etc.raw"},
+	}
+	for _, tt := range tests {
+		recordFormat = tt.format
+		r := newRecorder("rec", tt.perTransmission, 24000, 0)
+		if got := r.name(tt.e, start); got != filepath.FromSlash(tt.want) {
+			t.Errorf("%v: %s, want %s", tt.e, got, tt.want)
+		}
+	}
+}
+
+// the files under dir, and the samples in each
+func recordings(t *testing.T, dir string) ([]string, []int) {
+	var names []string
+	var samples []int
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			names = append(names, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, x := readWav(t, name)
+		samples = append(samples, len(x))
+	}
+	return names, samples
+}
+
+func TestRecorderMinDuration(t *testing.T) {
+	defer func(f string, c *controllerState) { recordFormat, controller = f, c }(recordFormat, controller)
+	recordFormat = "wav"
+	controller = &controllerState{mode: "fm"}
+
+	const rate = 1000
+	a := &scanEntry{freq: 145500000, label: "A"}
+	b := &scanEntry{freq: 146520000, label: "B"}
+	type block struct {
+		e    *scanEntry
+		open bool
+	}
+	// blocks are a tenth of a second
+	blocks := func(e *scanEntry, n int, open bool) []block {
+		var bs []block
+		for i := 0; i < n; i++ {
+			bs = append(bs, block{e, open})
+		}
+		return bs
+	}
+	join := func(parts ...[]block) []block {
+		var bs []block
+		for _, p := range parts {
+			bs = append(bs, p...)
+		}
+		return bs
+	}
+	tests := []struct {
+		name            string
+		perTransmission bool
+		minDuration     time.Duration
+		blocks          []block
+		// samples in each file, in name order
+		want []int
+	}{
+		{"too short", true, time.Second,
+			join(blocks(a, 9, true), blocks(a, 5, false)), nil},
+		{"long enough", true, time.Second,
+			join(blocks(a, 25, true), blocks(a, 1, false)), []int{2500}},
+		{"channel change", true, 500 * time.Millisecond,
+			join(blocks(a, 4, true), blocks(b, 7, true)), []int{700}},
+		{"no minimum", true, 0,
+			join(blocks(a, 1, true), blocks(a, 1, false), blocks(b, 2, true)), []int{100, 200}},
+		{"per channel", false, 0,
+			join(blocks(a, 2, true), blocks(a, 1, false), blocks(a, 3, true)), []int{500}},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "record")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		r := newRecorder(dir, tt.perTransmission, rate, tt.minDuration)
+		for _, b := range tt.blocks {
+			r.write(make([]int16, rate/10), b.e, b.open)
+		}
+		r.close()
+
+		names, samples := recordings(t, dir)
+		if len(samples) != len(tt.want) {
+			t.Errorf("%s: recorded %v", tt.name, names)
+			continue
+		}
+		for i := range samples {
+			if samples[i] != tt.want[i] {
+				t.Errorf("%s: %s has %d samples, want %d", tt.name, names[i], samples[i], tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	rtl "github.com/jpoirier/gortlsdr"
+)
+
+const (
+	// fraction of clipped samples above which gain is reduced
+	rfClipMax = 1e-4
+	// peak below which gain is raised (ADC counts from centre, max 128)
+	rfPeakMin = 64
+	// measurement window, in bytes of I/Q
+	rfWindow = 1 << 20
+)
+
+// software RF gain control
+//
+// Counts ADC clipping on the raw samples and steps through the tuner's gain
+// table to keep headroom without leaving the ADC underused.
+type rfGainState struct {
+	gains []int
+	idx   int
+	// skip the window after a change, the tuner needs time to settle
+	settle bool
+
+	samples int
+	clipped int
+	peak    int
+	level   int64
+
+	gainChan chan int
+}
+
+func newRfGain(dev *rtl.Context, current int) (*rfGainState, error) {
+	gains, err := dev.GetTunerGains()
+	if err != nil {
+		return nil, err
+	}
+	if len(gains) == 0 {
+		return nil, fmt.Errorf("No gains returned")
+	}
+
+	r := &rfGainState{
+		gains:    gains,
+		idx:      len(gains) / 2,
+		gainChan: make(chan int, 1),
+	}
+	if current != autoGain {
+		for i := range gains {
+			if math.Abs(float64(current-gains[i])) < math.Abs(float64(current-gains[r.idx])) {
+				r.idx = i
+			}
+		}
+	}
+	return r, nil
+}
+
+func (r *rfGainState) gain() int {
+	return r.gains[r.idx]
+}
+
+// called with raw bytes from the dongle, before any processing
+func (r *rfGainState) measure(buf []byte) {
+	for _, b := range buf {
+		// either rail of the ADC
+		if b == 0 || b == 255 {
+			r.clipped++
+		}
+		v := int(b) - 127
+		if v < 0 {
+			v = -v - 1
+		}
+		if v > r.peak {
+			r.peak = v
+		}
+		r.level += int64(v)
+	}
+	r.samples += len(buf)
+
+	if r.samples < rfWindow {
+		return
+	}
+
+	clipRatio := float64(r.clipped) / float64(r.samples)
+	peak := r.peak
+	floor := float64(r.level) / float64(r.samples)
+	r.samples, r.clipped, r.peak, r.level = 0, 0, 0, 0
+
+	if r.settle {
+		r.settle = false
+		return
+	}
+
+	prev := r.idx
+	switch {
+	case clipRatio > rfClipMax && r.idx > 0:
+		r.idx--
+	case clipRatio == 0 && peak < rfPeakMin && r.idx < len(r.gains)-1:
+		r.idx++
+	default:
+		return
+	}
+	r.settle = true
+
+	fmt.Fprintf(os.Stderr, "RF gain %.1fdB -> %.1fdB (clipped %.3f%%, peak %.1fdBFS, floor %.1fdBFS)\n",
+		float64(r.gains[prev])/10, float64(r.gain())/10, clipRatio*100,
+		20*math.Log10(float64(peak+1)/128), 20*math.Log10((floor+0.5)/128))
+
+	// replace any change the controller hasn't picked up yet
+	select {
+	case <-r.gainChan:
+	default:
+	}
+	r.gainChan <- r.gain()
+}
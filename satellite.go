@@ -0,0 +1,430 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	speedOfLight = 299792.458
+	// rad/s
+	earthRotation = 7.292115e-5
+	// retune once Doppler has moved this far, Hz
+	dopplerStep = 50
+	// pass search step and how far ahead to look
+	passStep    = 30 * time.Second
+	passHorizon = 24 * time.Hour
+)
+
+// observer on the WGS84 ellipsoid, radians and km
+type observer struct {
+	lat, lon, alt float64
+	ecef          [3]float64
+}
+
+// a satellite to listen to and its downlink
+type satellite struct {
+	tle   *tle
+	entry *scanEntry
+}
+
+type satPass struct {
+	sat      *satellite
+	aos, los time.Time
+	maxEl    float64
+}
+
+// position of a satellite as seen by the observer
+type lookAngles struct {
+	az, el float64
+	// km and km/s, positive when receding
+	rng, rate float64
+}
+
+// Satellite tracking
+//
+// Each satellite is propagated with SGP4. During a pass the dongle is
+// retuned to follow Doppler and the output recorded, between passes the
+// scanner is idle.
+type satState struct {
+	sats      []*satellite
+	obs       *observer
+	minEl     float64
+	recordDir string
+
+	pass *satPass
+	// Doppler shift currently tuned, Hz
+	shift int
+}
+
+func newSatState(tleFile string, sats satFlags, location string) (*satState, error) {
+	obs, err := parseLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	tles, err := loadTles(tleFile)
+	if err != nil {
+		return nil, err
+	}
+	found, err := findSatellites(tles, sats)
+	if err != nil {
+		return nil, err
+	}
+	return &satState{sats: found, obs: obs}, nil
+}
+
+// "lat,lon[,alt]" in degrees and metres
+func parseLocation(v string) (*observer, error) {
+	bits := strings.Split(v, ",")
+	if len(bits) < 2 || len(bits) > 3 {
+		return nil, fmt.Errorf("Location should be lat,lon[,alt]")
+	}
+	var vals [3]float64
+	for i, b := range bits {
+		var err error
+		vals[i], err = strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad location '%s'", v)
+		}
+	}
+	if math.Abs(vals[0]) > 90 || math.Abs(vals[1]) > 180 {
+		return nil, fmt.Errorf("Bad location '%s'", v)
+	}
+	return newObserver(vals[0], vals[1], vals[2]), nil
+}
+
+func newObserver(latDeg, lonDeg, altM float64) *observer {
+	o := &observer{
+		lat: latDeg * math.Pi / 180,
+		lon: lonDeg * math.Pi / 180,
+		alt: altM / 1000,
+	}
+	const a = 6378.137
+	const f = 1 / 298.257223563
+	e2 := f * (2 - f)
+	sinLat := math.Sin(o.lat)
+	n := a / math.Sqrt(1-e2*sinLat*sinLat)
+	o.ecef = [3]float64{
+		(n + o.alt) * math.Cos(o.lat) * math.Cos(o.lon),
+		(n + o.alt) * math.Cos(o.lat) * math.Sin(o.lon),
+		(n*(1-e2) + o.alt) * sinLat,
+	}
+	return o
+}
+
+// Greenwich mean sidereal time, radians
+func gmst(t time.Time) float64 {
+	jd := float64(t.UnixNano())/86400e9 + 2440587.5
+	tut1 := (jd - 2451545) / 36525
+	sec := -6.2e-6*tut1*tut1*tut1 + 0.093104*tut1*tut1 +
+		(876600*3600+8640184.812866)*tut1 + 67310.54841
+	g := math.Mod(sec*math.Pi/180/240, twoPi)
+	if g < 0 {
+		g += twoPi
+	}
+	return g
+}
+
+func (o *observer) look(t *tle, at time.Time) (lookAngles, error) {
+	r, v, err := t.at(at)
+	if err != nil {
+		return lookAngles{}, err
+	}
+
+	// TEME to earth fixed, ignoring polar motion
+	g := gmst(at)
+	sg, cg := math.Sin(g), math.Cos(g)
+	re := [3]float64{cg*r[0] + sg*r[1], -sg*r[0] + cg*r[1], r[2]}
+	ve := [3]float64{
+		cg*v[0] + sg*v[1] + earthRotation*re[1],
+		-sg*v[0] + cg*v[1] - earthRotation*re[0],
+		v[2],
+	}
+
+	var rho [3]float64
+	var rng, rate float64
+	for i := range rho {
+		rho[i] = re[i] - o.ecef[i]
+		rng += rho[i] * rho[i]
+		rate += rho[i] * ve[i]
+	}
+	rng = math.Sqrt(rng)
+	rate /= rng
+
+	sinLat, cosLat := math.Sin(o.lat), math.Cos(o.lat)
+	sinLon, cosLon := math.Sin(o.lon), math.Cos(o.lon)
+	east := -sinLon*rho[0] + cosLon*rho[1]
+	north := -sinLat*cosLon*rho[0] - sinLat*sinLon*rho[1] + cosLat*rho[2]
+	up := cosLat*cosLon*rho[0] + cosLat*sinLon*rho[1] + sinLat*rho[2]
+
+	az := math.Atan2(east, north) * 180 / math.Pi
+	if az < 0 {
+		az += 360
+	}
+	return lookAngles{
+		az:   az,
+		el:   math.Asin(up/rng) * 180 / math.Pi,
+		rng:  rng,
+		rate: rate,
+	}, nil
+}
+
+// received frequency offset from f, Hz
+func (l lookAngles) doppler(f uint32) int {
+	return int(round(-float64(f) * l.rate / speedOfLight))
+}
+
+// Next pass above minEl starting after from, nil if none within the horizon
+func (o *observer) nextPass(sat *satellite, from time.Time, minEl float64) (*satPass, error) {
+	above := func(t time.Time) (bool, float64, error) {
+		l, err := o.look(sat.tle, t)
+		return l.el >= minEl, l.el, err
+	}
+	// refine a crossing between a and b to the second
+	crossing := func(a, b time.Time, rising bool) (time.Time, error) {
+		for b.Sub(a) > time.Second {
+			mid := a.Add(b.Sub(a) / 2)
+			up, _, err := above(mid)
+			if err != nil {
+				return mid, err
+			}
+			if up == rising {
+				b = mid
+			} else {
+				a = mid
+			}
+		}
+		return b, nil
+	}
+
+	up, _, err := above(from)
+	if err != nil {
+		return nil, err
+	}
+	// already in a pass, find when it started
+	t := from
+	if up {
+		for up && from.Sub(t) < passHorizon {
+			t = t.Add(-passStep)
+			up, _, err = above(t)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for end := from.Add(passHorizon); t.Before(end); t = t.Add(passStep) {
+		next := t.Add(passStep)
+		up, _, err := above(next)
+		if err != nil {
+			return nil, err
+		}
+		if !up {
+			continue
+		}
+		p := &satPass{sat: sat}
+		p.aos, err = crossing(t, next, true)
+		if err != nil {
+			return nil, err
+		}
+
+		// follow the pass to LOS, keeping the highest elevation
+		t = next
+		for {
+			next = t.Add(passStep)
+			var el float64
+			up, el, err = above(t)
+			if err != nil {
+				return nil, err
+			}
+			if el > p.maxEl {
+				p.maxEl = el
+			}
+			upNext, _, err := above(next)
+			if err != nil {
+				return nil, err
+			}
+			if !upNext {
+				break
+			}
+			t = next
+		}
+		p.los, err = crossing(t, next, false)
+		if err != nil {
+			return nil, err
+		}
+		if p.los.After(from) {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (p *satPass) String() string {
+	return fmt.Sprintf("%s AOS %s LOS %s max elevation %.0f°", p.sat.tle.name,
+		p.aos.Local().Format("Mon 15:04:05"), p.los.Local().Format("15:04:05"), p.maxEl)
+}
+
+// Match -sat names against the element sets, by name or catalogue number
+func findSatellites(tles []*tle, sats satFlags) ([]*satellite, error) {
+	var found []*satellite
+	for _, s := range sats {
+		var match *tle
+		for _, t := range tles {
+			if strings.EqualFold(t.name, s.name) || t.catalog == s.name {
+				match = t
+				break
+			}
+		}
+		if match == nil {
+			return nil, fmt.Errorf("No element set for satellite '%s'", s.name)
+		}
+		found = append(found, &satellite{
+			tle:   match,
+			entry: &scanEntry{label: match.name, freq: s.freq},
+		})
+	}
+	return found, nil
+}
+
+// list upcoming passes
+func (s *satState) logPasses(from time.Time) {
+	for _, sat := range s.sats {
+		p, err := s.obs.nextPass(sat, from, s.minEl)
+		switch {
+		case err != nil:
+			fmt.Fprintln(os.Stderr, err)
+		case p == nil:
+			fmt.Fprintf(os.Stderr, "No pass of %s in the next %s\n", sat.tle.name, passHorizon)
+		default:
+			fmt.Fprintf(os.Stderr, "Next pass %s\n", p)
+		}
+	}
+}
+
+// Called every second by the controller, starting and stopping passes and
+// retuning for Doppler
+func (s *satState) update(c *controllerState, now time.Time) error {
+	if s.pass != nil {
+		l, err := s.obs.look(s.pass.sat.tle, now)
+		if err != nil {
+			return err
+		}
+		if l.el < s.minEl {
+			fmt.Fprintf(os.Stderr, "LOS %s\n", s.pass.sat.tle.name)
+			c.mu.Lock()
+			if demod.agcEnable {
+				c.agcGain[s.pass.sat.entry.freq] = demod.agc.gain()
+			}
+			s.pass = nil
+			c.idle = true
+			c.mu.Unlock()
+			err = output.setFile("", nil)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to open output: %s\n", err)
+			}
+			s.logPasses(now)
+			return nil
+		}
+		return s.track(l)
+	}
+
+	for _, sat := range s.sats {
+		l, err := s.obs.look(sat.tle, now)
+		if err != nil {
+			return err
+		}
+		if l.el < s.minEl {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "AOS %s, azimuth %.0f°\n", sat.tle.name, l.az)
+		c.setChannels([]*scanEntry{sat.entry}, true)
+		c.mu.Lock()
+		s.pass = &satPass{sat: sat, aos: now}
+		s.shift = 0
+		if demod.agcEnable {
+			demod.agc.setGain(c.agcGain[sat.entry.freq])
+		}
+		c.mu.Unlock()
+		err = c.retune()
+		if err != nil {
+			return err
+		}
+		c.setIdle(false)
+
+		if s.recordDir != "" {
+			name := fileLabel(sat.tle.name)
+			name = filepath.Join(s.recordDir, now.UTC().Format("20060102T150405")+"_"+name+"."+recordFormat)
+			fmt.Fprintf(os.Stderr, "Recording to %s\n", name)
+			err = output.setFile(name, audioTags(sat.entry, c.modeFor(sat.entry), now))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to open output: %s\n", err)
+			}
+		}
+		return s.track(l)
+	}
+	return nil
+}
+
+// retune for Doppler when it has moved far enough
+func (s *satState) track(l lookAngles) error {
+	shift := l.doppler(s.pass.sat.entry.freq)
+	if math.Abs(float64(shift-s.shift)) < dopplerStep {
+		return nil
+	}
+	controller.mu.Lock()
+	s.shift = shift
+	controller.mu.Unlock()
+	err := dongle.dev.SetCenterFreq(tunerFreq())
+	if err != nil {
+		return fmt.Errorf("Error setting frequency %d", tunerFreq())
+	}
+	return nil
+}
+
+// -sat values, name=downlink
+type satFlag struct {
+	name string
+	freq uint32
+}
+
+type satFlags []satFlag
+
+func (f *satFlags) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *satFlags) Set(val string) error {
+	i := strings.LastIndex(val, "=")
+	if i < 0 {
+		return fmt.Errorf("expected name=frequency e.g. 'NOAA 19=137.1M'")
+	}
+	freq, err := freqHz(val[i+1:])
+	if err != nil {
+		return err
+	}
+	*f = append(*f, satFlag{name: strings.TrimSpace(val[:i]), freq: freq})
+	return nil
+}
@@ -0,0 +1,376 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var demodModes = map[string]bool{
+	"am":   true,
+	"fm":   true,
+	"nfm":  true,
+	"wbfm": true,
+}
+
+// One channel of the scan list. Zero values fall back to the command line
+// settings.
+type scanEntry struct {
+	label     string
+	freq      uint32
+	mode      string
+	bandwidth int
+	// dB, as -l
+	squelch int
+	// CTCSS Hz
+	tone float64
+	// tenths of a dB, or autoGain
+	gain     int
+	gainSet  bool
+	filters  string
+	priority bool
+	lockout  bool
+	// skipped for a while at runtime
+	skipUntil time.Time
+	// kept so memories imported from CHIRP export unchanged
+	duplex    string
+	offset    uint32
+	txTone    float64
+	toneMode  string
+	crossMode string
+}
+
+// Load a scan list, YAML by .yaml/.yml extension otherwise CSV
+//
+// CSV needs a header row naming the columns, in any order:
+//
+//	label,frequency,mode,bandwidth,squelch,tone,gain,filters,priority,lockout
+//	Simplex,145.5M,fm,12.5k,20,88.5,40,hpf,true,false
+//
+// YAML is a list of entries with the same keys. CSV exported by CHIRP is
+// also accepted, channels in modes we can't demodulate are skipped.
+func loadScanList(name string) ([]*scanEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []map[string]string
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		rows, err = readYamlRows(f)
+	default:
+		rows, err = readCsvRows(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	var entries []*scanEntry
+	for i, row := range rows {
+		if isChirpRow(row) {
+			var ok bool
+			if row, ok = chirpRow(row); !ok {
+				fmt.Fprintf(os.Stderr, "%s entry %d: skipping unsupported mode\n", name, i+1)
+				continue
+			}
+		}
+		e, err := parseScanEntry(row)
+		if err != nil {
+			return nil, fmt.Errorf("%s entry %d: %s", name, i+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func readYamlRows(r io.Reader) ([]map[string]string, error) {
+	items, err := readYaml(r)
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]string
+	for _, item := range items {
+		for k := range item.lists {
+			return nil, fmt.Errorf("line %d: expected a single value for '%s'", item.line, k)
+		}
+		rows = append(rows, item.scalars)
+	}
+	return rows, nil
+}
+
+func readCsvRows(r io.Reader) ([]map[string]string, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	cr.FieldsPerRecord = -1
+
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+
+	var rows []map[string]string
+	for _, rec := range records[1:] {
+		row := make(map[string]string)
+		for i, v := range rec {
+			if i < len(header) {
+				row[header[i]] = strings.TrimSpace(v)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Frequency from a scan list column, with a k, M or G suffix or in Hz.
+// Unlike freqHz anything else is an error, a mistake in a file is easy
+// to miss.
+func columnHz(v string) (uint32, error) {
+	if v == "" {
+		return 0, fmt.Errorf("no frequency")
+	}
+	mult := 1.0
+	switch strings.ToUpper(v[len(v)-1:]) {
+	case "K":
+		mult = 1e3
+	case "M":
+		mult = 1e6
+	case "G":
+		mult = 1e9
+	}
+	num := v
+	if mult != 1 {
+		num = v[:len(v)-1]
+	}
+	f64, err := strconv.ParseFloat(num, 64)
+	hz := round(f64 * mult)
+	// fractions of a Hz are more likely a missing suffix
+	if err != nil || !(hz >= 0 && hz <= math.MaxUint32) || (mult == 1 && hz != f64) {
+		return 0, fmt.Errorf("bad frequency '%s'", v)
+	}
+	return uint32(hz), nil
+}
+
+func parseScanEntry(row map[string]string) (e *scanEntry, err error) {
+	e = &scanEntry{
+		label:     row["label"],
+		filters:   row["filters"],
+		duplex:    row["duplex"],
+		toneMode:  row["tonemode"],
+		crossMode: row["crossmode"],
+	}
+
+	if row["frequency"] == "" {
+		return nil, fmt.Errorf("No frequency")
+	}
+	e.freq, err = columnHz(row["frequency"])
+	if err != nil {
+		return nil, fmt.Errorf("Bad frequency '%s'", row["frequency"])
+	}
+
+	e.mode = strings.ToLower(row["mode"])
+	if e.mode == "nfm" {
+		e.mode = "fm"
+	}
+	if e.mode != "" && !demodModes[e.mode] {
+		return nil, fmt.Errorf("Unknown mode '%s'", row["mode"])
+	}
+
+	if v := row["bandwidth"]; v != "" {
+		var bw uint32
+		bw, err = columnHz(v)
+		if err != nil {
+			return nil, fmt.Errorf("Bad bandwidth '%s'", v)
+		}
+		e.bandwidth = int(bw)
+	}
+
+	if v := row["squelch"]; v != "" {
+		e.squelch, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("Bad squelch '%s'", v)
+		}
+	}
+
+	if v := row["tone"]; v != "" {
+		e.tone, err = strconv.ParseFloat(v, 64)
+		if err != nil || (e.tone != 0 && nearestTone(e.tone) == 0) {
+			return nil, fmt.Errorf("Bad CTCSS tone '%s'", v)
+		}
+		e.tone = nearestTone(e.tone)
+	}
+
+	if v := row["offset"]; v != "" {
+		e.offset, err = columnHz(v)
+		if err != nil {
+			return nil, fmt.Errorf("Bad offset '%s'", v)
+		}
+	}
+
+	if v := row["txtone"]; v != "" {
+		e.txTone, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad transmit tone '%s'", v)
+		}
+	}
+
+	switch v := strings.ToLower(row["gain"]); v {
+	case "":
+	case "auto":
+		e.gain = autoGain
+		e.gainSet = true
+	default:
+		var db float64
+		db, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad gain '%s'", v)
+		}
+		e.gain = int(round(db * 10))
+		e.gainSet = true
+	}
+
+	e.priority, err = parseFlag(row["priority"])
+	if err != nil {
+		return nil, fmt.Errorf("Bad priority '%s'", row["priority"])
+	}
+	e.lockout, err = parseFlag(row["lockout"])
+	if err != nil {
+		return nil, fmt.Errorf("Bad lockout '%s'", row["lockout"])
+	}
+
+	return e, nil
+}
+
+// boolean column, empty is false
+func parseFlag(v string) (bool, error) {
+	switch strings.ToLower(v) {
+	case "", "no", "n":
+		return false, nil
+	case "yes", "y", "x":
+		return true, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+func (e *scanEntry) String() string {
+	if e.label != "" {
+		return fmt.Sprintf("%s (%d Hz)", e.label, e.freq)
+	}
+	return fmt.Sprintf("%d Hz", e.freq)
+}
+
+// Configure d for entry e, anything e doesn't set comes from the command
+// line. Squelch is left to the caller as it depends on the capture.
+func (s *controllerState) configure(d *demodState, e *scanEntry) {
+	mode := s.modeFor(e)
+	switch mode {
+	case "fm", "wbfm":
+		d.modeDemod = fmDemod
+	default:
+		d.modeDemod = amDemod
+	}
+
+	spec := e.filters
+	if spec == "" {
+		spec = s.filterSpecs.forMode(mode)
+	}
+	if spec != d.filterSpec {
+		// specs were checked when the scan list was loaded
+		d.filterSpec = spec
+		d.filters, _ = newFilterChain(spec, d.audioRate())
+	}
+
+	if e.bandwidth != d.bandwidth {
+		d.bandwidth = e.bandwidth
+		d.ifFilter = newIQLowPass(d.rateIn, e.bandwidth)
+	}
+
+	d.toneSquelch = e.tone
+	if d.toneSquelch > 0 && d.tone == nil {
+		d.tone = newToneDecoder(d.rateOut)
+	}
+}
+
+// Mark the -prio frequencies as priority channels, adding any that aren't
+// already scanned
+func (s *controllerState) markPriority() {
+	for _, f := range s.prioFreqs {
+		found := false
+		for _, e := range s.entries {
+			if e.freq == f {
+				e.priority = true
+				found = true
+			}
+		}
+		if !found {
+			s.entries = append(s.entries, &scanEntry{freq: f, priority: true})
+		}
+	}
+}
+
+// demodulation mode for e
+func (s *controllerState) modeFor(e *scanEntry) string {
+	if e.mode != "" {
+		return e.mode
+	}
+	return s.mode
+}
+
+// squelch level in dB for e
+func (s *controllerState) squelchFor(e *scanEntry) int {
+	if e.squelch != 0 {
+		return e.squelch
+	}
+	return s.squelchDb
+}
+
+// Check entries fit the command line, wbfm runs at different rates so
+// can't be mixed with narrowband modes
+func (s *controllerState) checkEntries(entries []*scanEntry, audioRate int) error {
+	for _, e := range entries {
+		if e.mode != "" && (e.mode == "wbfm") != s.wbMode {
+			return fmt.Errorf("%s: wbfm can't be mixed with other modes", e)
+		}
+		if _, err := newFilterChain(e.filters, audioRate); err != nil {
+			return fmt.Errorf("%s: %s", e, err)
+		}
+	}
+	for _, spec := range s.filterSpecs {
+		if _, err := newFilterChain(spec, audioRate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseScanEntry(t *testing.T) {
+	tests := []struct {
+		name string
+		row  map[string]string
+		want *scanEntry
+	}{
+		{"frequency only", map[string]string{"frequency": "145.5M"},
+			&scanEntry{freq: 145500000}},
+		{"everything", map[string]string{
+			"label": "Simplex", "frequency": "145.5M", "mode": "FM", "bandwidth": "12.5k",
+			"squelch": "20", "tone": "88.5", "gain": "40", "filters": "hpf",
+			"priority": "yes", "lockout": "no",
+		}, &scanEntry{label: "Simplex", freq: 145500000, mode: "fm", bandwidth: 12500,
+			squelch: 20, tone: 88.5, gain: 400, gainSet: true, filters: "hpf", priority: true}},
+		{"nfm is fm", map[string]string{"frequency": "446.00625M", "mode": "nfm"},
+			&scanEntry{freq: 446006250, mode: "fm"}},
+		{"tone rounded to standard", map[string]string{"frequency": "145.5M", "tone": "88"},
+			&scanEntry{freq: 145500000, tone: 88.5}},
+		{"auto gain", map[string]string{"frequency": "145.5M", "gain": "auto"},
+			&scanEntry{freq: 145500000, gain: autoGain, gainSet: true}},
+		{"flags", map[string]string{"frequency": "145.5M", "priority": "x", "lockout": "true"},
+			&scanEntry{freq: 145500000, priority: true, lockout: true}},
+		{"bare numbers are Hz", map[string]string{"frequency": "145500000", "bandwidth": "12500", "offset": "600000"},
+			&scanEntry{freq: 145500000, bandwidth: 12500, offset: 600000}},
+		{"suffixes", map[string]string{"frequency": "1.2967G", "bandwidth": "200K", "offset": "7.6m"},
+			&scanEntry{freq: 1296700000, bandwidth: 200000, offset: 7600000}},
+	}
+	for _, tt := range tests {
+		e, err := parseScanEntry(tt.row)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(e, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *e, *tt.want)
+		}
+	}
+}
+
+func TestParseScanEntryErrors(t *testing.T) {
+	tests := []map[string]string{
+		{"label": "no frequency"},
+		{"frequency": "two metres"},
+		{"frequency": "145.5Q"},
+		{"frequency": "145.5"},
+		{"frequency": "5G"},
+		{"frequency": "NaNM"},
+		{"frequency": "-145.5M"},
+		{"frequency": "145.5M", "mode": "usb"},
+		{"frequency": "145.5M", "bandwidth": "wide"},
+		{"frequency": "145.5M", "bandwidth": "12.5"},
+		{"frequency": "145.5M", "offset": "600kHz"},
+		{"frequency": "145.5M", "squelch": "loud"},
+		{"frequency": "145.5M", "tone": "42"},
+		{"frequency": "145.5M", "gain": "max"},
+		{"frequency": "145.5M", "priority": "maybe"},
+		{"frequency": "145.5M", "lockout": "2"},
+	}
+	for _, row := range tests {
+		if _, err := parseScanEntry(row); err == nil {
+			t.Errorf("%v: no error", row)
+		}
+	}
+}
+
+func TestLoadScanList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scanlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := []*scanEntry{
+		{label: "Simplex", freq: 145500000, mode: "fm", tone: 88.5},
+		{freq: 146520000, priority: true},
+	}
+	tests := []struct {
+		name, data string
+	}{
+		{"list.csv", "# comment\nLabel,Frequency,Mode,Tone,Priority\nSimplex,145.5M,fm,88.5,\n,146.52M,,,yes\n"},
+		{"list.yaml", "- label: Simplex\n  frequency: 145.5M\n  mode: fm\n  tone: 88.5\n- frequency: 146.52M\n  priority: yes\n"},
+		{"list.yml", "-\n  label: \"Simplex\"\n  frequency: 145.5M # comment\n  mode: fm\n  tone: 88.5\n-\n  frequency: 146.52M\n  priority: yes\n"},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(name, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := loadScanList(name)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(entries, want) {
+			t.Errorf("%s: got %d entries %v, want %v", tt.name, len(entries), entries, want)
+		}
+	}
+
+	bad := []struct {
+		name, data string
+	}{
+		{"bad.csv", "frequency,mode\n145.5M,usb\n"},
+		{"bad.yaml", "- frequency: [145.5M, 146.52M]\n"},
+		{"indent.yaml", "- frequency: 145.5M\n   mode: fm\n"},
+	}
+	for _, tt := range bad {
+		name := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(name, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadScanList(name); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+	if _, err := loadScanList(filepath.Join(dir, "missing.csv")); err == nil {
+		t.Errorf("missing file: no error")
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how often the schedule is checked
+const scheduleCheck = 10 * time.Second
+
+var weekdays = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+var jobKeys = map[string]bool{
+	"name":        true,
+	"frequencies": true,
+	"scan":        true,
+	"mode":        true,
+	"squelch":     true,
+	"output":      true,
+	"start":       true,
+	"stop":        true,
+	"days":        true,
+}
+
+// a job as written in the schedule file
+type jobConfig struct {
+	name        string
+	frequencies []string
+	scan        string
+	mode        string
+	squelch     int
+	output      string
+	start       string
+	stop        string
+	days        []string
+}
+
+type scheduleJob struct {
+	name    string
+	entries []*scanEntry
+	// empty for the command line output
+	output string
+	// minutes after midnight, stop before start runs past midnight
+	start, stop int
+	days        map[time.Weekday]bool
+}
+
+// Scheduled jobs, the first running at any time wins. When none are
+// running the command line channels are scanned, or if there are none the
+// scanner is idle.
+type schedule struct {
+	jobs []*scheduleJob
+}
+
+// Load a schedule
+//
+//   - name: airband
+//     scan: airband.csv
+//     mode: am
+//     squelch: 20
+//     start: "07:00"
+//     stop: "19:00"
+//     days: [weekdays]
+//   - name: 2m net
+//     frequencies: [146.52M]
+//     output: net.raw
+//     start: "20:00"
+//     stop: "21:00"
+//     days: [tue]
+func loadSchedule(name string) (*schedule, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	items, err := readYaml(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	sched := &schedule{}
+	for i, item := range items {
+		c, err := parseJobConfig(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s job %d: %s", name, i+1, err)
+		}
+		job, err := newScheduleJob(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s job %d: %s", name, i+1, err)
+		}
+		sched.jobs = append(sched.jobs, job)
+	}
+	if len(sched.jobs) == 0 {
+		return nil, fmt.Errorf("%s: no jobs", name)
+	}
+	return sched, nil
+}
+
+func parseJobConfig(item *yamlItem) (c jobConfig, err error) {
+	for k := range item.scalars {
+		if !jobKeys[k] {
+			return c, fmt.Errorf("unknown setting '%s'", k)
+		}
+	}
+	for k := range item.lists {
+		if !jobKeys[k] {
+			return c, fmt.Errorf("unknown setting '%s'", k)
+		}
+	}
+
+	c.frequencies = item.list("frequencies")
+	c.days = item.list("days")
+	for _, v := range []struct {
+		key string
+		val *string
+	}{
+		{"name", &c.name},
+		{"scan", &c.scan},
+		{"mode", &c.mode},
+		{"output", &c.output},
+		{"start", &c.start},
+		{"stop", &c.stop},
+	} {
+		*v.val, err = item.scalar(v.key)
+		if err != nil {
+			return c, err
+		}
+	}
+	squelch, err := item.scalar("squelch")
+	if err != nil {
+		return c, err
+	}
+	if squelch != "" {
+		c.squelch, err = strconv.Atoi(squelch)
+		if err != nil {
+			return c, fmt.Errorf("Bad squelch '%s'", squelch)
+		}
+	}
+	return c, nil
+}
+
+func newScheduleJob(c jobConfig) (*scheduleJob, error) {
+	job := &scheduleJob{
+		name:   c.name,
+		output: c.output,
+		days:   make(map[time.Weekday]bool),
+	}
+	if job.name == "" {
+		job.name = strings.Join(c.frequencies, " ")
+	}
+
+	for _, f := range c.frequencies {
+		freqs, err := setFreqs(f)
+		if err != nil {
+			return nil, fmt.Errorf("Bad frequency '%s'", f)
+		}
+		for _, freq := range freqs {
+			job.entries = append(job.entries, &scanEntry{freq: freq})
+		}
+	}
+	if c.scan != "" {
+		entries, err := loadScanList(c.scan)
+		if err != nil {
+			return nil, err
+		}
+		job.entries = append(job.entries, entries...)
+	}
+	if len(job.entries) == 0 {
+		return nil, fmt.Errorf("No frequencies")
+	}
+
+	mode := strings.ToLower(c.mode)
+	if mode == "nfm" {
+		mode = "fm"
+	}
+	if mode != "" && !demodModes[mode] {
+		return nil, fmt.Errorf("Unknown mode '%s'", c.mode)
+	}
+	// job settings are the defaults for its channels
+	for _, e := range job.entries {
+		if e.mode == "" {
+			e.mode = mode
+		}
+		if e.squelch == 0 {
+			e.squelch = c.squelch
+		}
+	}
+
+	var err error
+	job.start, err = parseClock(c.start)
+	if err != nil {
+		return nil, fmt.Errorf("Bad start time '%s'", c.start)
+	}
+	job.stop, err = parseClock(c.stop)
+	if err != nil {
+		return nil, fmt.Errorf("Bad stop time '%s'", c.stop)
+	}
+	if job.start == job.stop {
+		return nil, fmt.Errorf("Start and stop times are the same")
+	}
+
+	if len(c.days) == 0 {
+		c.days = []string{"weekdays", "weekends"}
+	}
+	for _, d := range c.days {
+		l := strings.ToLower(d)
+		days, ok := weekdays[l]
+		// full day names
+		if !ok && len(l) > 3 {
+			days, ok = weekdays[l[:3]]
+		}
+		if !ok {
+			return nil, fmt.Errorf("Unknown day '%s'", d)
+		}
+		for _, day := range days {
+			job.days[day] = true
+		}
+	}
+
+	return job, nil
+}
+
+// "HH:MM" to minutes after midnight
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// running at t, a job running past midnight belongs to the day it started
+func (j *scheduleJob) running(t time.Time) bool {
+	now := t.Hour()*60 + t.Minute()
+	if j.start < j.stop {
+		return j.days[t.Weekday()] && now >= j.start && now < j.stop
+	}
+	if now >= j.start {
+		return j.days[t.Weekday()]
+	}
+	return now < j.stop && j.days[t.AddDate(0, 0, -1).Weekday()]
+}
+
+// job running at t, nil if none
+func (sched *schedule) active(t time.Time) *scheduleJob {
+	for _, j := range sched.jobs {
+		if j.running(t) {
+			return j
+		}
+	}
+	return nil
+}
+
+// Switch to job, nil for the command line channels. With neither the
+// scanner idles on the last channels.
+func (s *controllerState) startJob(job *scheduleJob) {
+	s.job = job
+	s.prioReturn = -1
+	if s.search != nil {
+		s.search.queue = nil
+	}
+
+	var err error
+	switch {
+	case job != nil:
+		fmt.Fprintf(os.Stderr, "Schedule: starting %s\n", job.name)
+		s.setChannels(job.entries, false)
+		err = output.setFile(job.output, []string{"TITLE=" + job.name, "DATE=" + time.Now().Format(time.RFC3339)})
+	case len(s.defaultEntries) > 0:
+		fmt.Fprintln(os.Stderr, "Schedule: no job running, scanning command line channels")
+		s.setChannels(s.defaultEntries, false)
+		err = output.setFile("", nil)
+	default:
+		fmt.Fprintln(os.Stderr, "Schedule: no job running, idle")
+		s.setChannels(s.entries, true)
+		err = output.setFile("", nil)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open output: %s\n", err)
+	}
+}
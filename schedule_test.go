@@ -0,0 +1,157 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSchedule = `
+- name: airband
+  frequencies: [118.1M, 118.7M]
+  mode: am
+  squelch: 20
+  start: "07:00"
+  stop: "19:00"
+  days: [weekdays]
+- name: overnight
+  frequencies:
+    - 144M:144.025M:12.5k
+  start: "22:00"
+  stop: "02:00"
+  days: [friday]
+- frequencies: [146.52M]
+  start: "06:00"
+  stop: "08:00"
+`
+
+func TestLoadSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "jobs.yaml")
+	if err := ioutil.WriteFile(name, []byte(testSchedule), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sched, err := loadSchedule(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sched.jobs) != 3 {
+		t.Fatalf("%d jobs, want 3", len(sched.jobs))
+	}
+
+	air := sched.jobs[0]
+	if air.name != "airband" || len(air.entries) != 2 || air.start != 7*60 || air.stop != 19*60 {
+		t.Errorf("airband: %+v", *air)
+	}
+	for _, e := range air.entries {
+		if e.mode != "am" || e.squelch != 20 {
+			t.Errorf("airband %s: mode %s squelch %d, want the job's", e, e.mode, e.squelch)
+		}
+	}
+	if n := len(sched.jobs[1].entries); n != 3 {
+		t.Errorf("overnight: %d channels from a range, want 3", n)
+	}
+	if sched.jobs[2].name != "146.52M" {
+		t.Errorf("unnamed job called '%s'", sched.jobs[2].name)
+	}
+
+	// Friday 2 January 2026 and the days after
+	day := func(d, hour, min int) time.Time {
+		return time.Date(2026, time.January, d, hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		at   time.Time
+		want string
+	}{
+		{day(2, 7, 0), "airband"},
+		{day(2, 7, 30), "airband"},
+		{day(2, 18, 59), "airband"},
+		{day(2, 19, 0), ""},
+		{day(2, 6, 30), "146.52M"},
+		{day(2, 23, 0), "overnight"},
+		{day(3, 1, 59), "overnight"},
+		{day(3, 2, 0), ""},
+		{day(3, 7, 30), "146.52M"},
+		{day(3, 23, 0), ""},
+		{day(4, 1, 0), ""},
+	}
+	for _, tt := range tests {
+		job := sched.active(tt.at)
+		got := ""
+		if job != nil {
+			got = job.name
+		}
+		if got != tt.want {
+			t.Errorf("%s: '%s' running, want '%s'", tt.at.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestParseJobErrors(t *testing.T) {
+	tests := []struct {
+		yaml, err string
+	}{
+		{"- frequencies: [146.52M]\n  start: \"06:00\"\n  stop: \"08:00\"\n  volume: 11\n", "unknown setting"},
+		{"- frequencies: [146.52M]\n  start: \"06:00\"\n  stop: \"06:00\"\n", "same"},
+		{"- frequencies: [146.52M]\n  start: \"6pm\"\n  stop: \"08:00\"\n", "start time"},
+		{"- frequencies: [146.52M]\n  start: \"06:00\"\n  stop: \"25:00\"\n", "stop time"},
+		{"- frequencies: [146.52M]\n  start: \"06:00\"\n  stop: \"08:00\"\n  days: [someday]\n", "Unknown day"},
+		{"- frequencies: [146.52M]\n  mode: usb\n  start: \"06:00\"\n  stop: \"08:00\"\n", "Unknown mode"},
+		{"- frequencies: [146.52M]\n  squelch: loud\n  start: \"06:00\"\n  stop: \"08:00\"\n", "Bad squelch"},
+		{"- name: nothing\n  start: \"06:00\"\n  stop: \"08:00\"\n", "No frequencies"},
+		{"- frequencies: [146.52M]\n  start: [\"06:00\"]\n  stop: \"08:00\"\n", "single value"},
+	}
+	for _, tt := range tests {
+		items, err := readYaml(strings.NewReader(tt.yaml))
+		if err != nil {
+			t.Fatalf("%q: %s", tt.yaml, err)
+		}
+		c, err := parseJobConfig(items[0])
+		if err == nil {
+			_, err = newScheduleJob(c)
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: error %v, want one containing '%s'", tt.yaml, err, tt.err)
+		}
+	}
+}
+
+func TestSetChannels(t *testing.T) {
+	s := &controllerState{}
+	entries := []*scanEntry{{freq: 1, lockout: true}, {freq: 2}, {freq: 3}}
+	s.setChannels(entries, false)
+	if e := s.current(); e == nil || e.freq != 2 {
+		t.Errorf("listening to %v, want the first channel not locked out", e)
+	}
+	s.setIdle(true)
+	if e := s.current(); e != nil {
+		t.Errorf("listening to %v while idle", e)
+	}
+	s.setChannels([]*scanEntry{{freq: 4, lockout: true}}, false)
+	if e := s.current(); e == nil || e.freq != 4 {
+		t.Errorf("listening to %v with every channel locked out, want the first", e)
+	}
+}
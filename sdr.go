@@ -23,8 +23,6 @@ import (
 	rtl "github.com/jpoirier/gortlsdr"
 )
 
-var deemphAvg int
-
 func round(x float64) float64 {
 	if x > 0.0 {
 		return math.Floor(x + 0.5)
@@ -86,6 +84,32 @@ func amDemod(am *demodState) {
 	am.lowpassed = am.lowpassed[:lpLen/2]
 }
 
+// FM discriminators, see customAtan
+const (
+	atanStd = iota
+	atanFast
+	atanLut
+	atanQuad
+)
+
+var atanModes = map[string]int{
+	"std":  atanStd,
+	"fast": atanFast,
+	"lut":  atanLut,
+	"quad": atanQuad,
+}
+
+// atan(i/atanLutSize) for i in 0..atanLutSize, note pi = 1<<14
+const atanLutSize = 1 << 10
+
+var atanTable [atanLutSize + 1]int
+
+func init() {
+	for i := range atanTable {
+		atanTable[i] = int(round(math.Atan(float64(i)/atanLutSize) / math.Pi * (1 << 14)))
+	}
+}
+
 func polarDiscriminant(ar, aj, br, bj int) int {
 	var cr, cj int
 	var angle float64
@@ -124,18 +148,85 @@ func fastAtan2(y, x int) int {
 	return angle
 }
 
+func polarDiscLut(ar, aj, br, bj int) int {
+	var cr, cj int
+	cr = ar*br - aj*-bj
+	cj = aj*br + ar*-bj
+	return lutAtan2(cj, cr)
+}
+
+func lutAtan2(y, x int) int {
+	var xabs, yabs, angle int
+	if x == 0 && y == 0 {
+		return 0
+	}
+	xabs, yabs = x, y
+	if xabs < 0 {
+		xabs = -xabs
+	}
+	if yabs < 0 {
+		yabs = -yabs
+	}
+	// reduce to the first octant, int64 so ARM doesn't overflow
+	if yabs <= xabs {
+		angle = atanTable[int64(yabs)*atanLutSize/int64(xabs)]
+	} else {
+		angle = (1 << 13) - atanTable[int64(xabs)*atanLutSize/int64(yabs)]
+	}
+	if x < 0 {
+		angle = (1 << 14) - angle
+	}
+	if y < 0 {
+		return -angle
+	}
+	return angle
+}
+
+// Quadrature discriminator, the imaginary part of a * conj(b) is
+// |a||b|sin(angle). Division free, amplitude is normalised once per
+// block with scale from quadScale.
+func polarDiscQuad(ar, aj, br, bj int, scale int64) int {
+	cj := int64(aj)*int64(br) - int64(ar)*int64(bj)
+	return int((cj * scale) >> 16)
+}
+
+// scale for polarDiscQuad from the mean power of a block of I/Q
+func quadScale(lp []int16) int64 {
+	var p int64
+	n := int64(len(lp) / 2)
+	if n == 0 {
+		return 0
+	}
+	for _, s := range lp {
+		p += int64(s) * int64(s)
+	}
+	p /= n
+	if p == 0 {
+		return 0
+	}
+	return int64((1 << 14) / math.Pi * (1 << 16) / float64(p))
+}
+
 func fmDemod(fm *demodState) {
 	var i, pcm int
+	var scale int64
 	lp := fm.lowpassed
 	lpLen := len(fm.lowpassed)
 	pr := fm.preR
 	pj := fm.preJ
+	if fm.customAtan == atanQuad {
+		scale = quadScale(lp)
+	}
 	for i = 2; i < (lpLen - 1); i += 2 {
 		switch fm.customAtan {
-		case 0:
+		case atanStd:
 			pcm = polarDiscriminant(int(lp[i]), int(lp[i+1]), int(pr), int(pj))
-		case 1:
+		case atanFast:
 			pcm = polarDiscFast(int(lp[i]), int(lp[i+1]), int(pr), int(pj))
+		case atanLut:
+			pcm = polarDiscLut(int(lp[i]), int(lp[i+1]), int(pr), int(pj))
+		case atanQuad:
+			pcm = polarDiscQuad(int(lp[i]), int(lp[i+1]), int(pr), int(pj), scale)
 		}
 		pr = lp[i]
 		pj = lp[i+1]
@@ -210,16 +301,21 @@ func deemphFilter(fm *demodState) {
 	var d int
 	// de-emph IIR
 	for i := 0; i < len(fm.lowpassed); i++ {
-		d = int(fm.lowpassed[i]) - deemphAvg
+		d = int(fm.lowpassed[i]) - fm.deemphAvg
 		if d > 0 {
-			deemphAvg += (d + fm.deemphA/2) / fm.deemphA
+			fm.deemphAvg += (d + fm.deemphA/2) / fm.deemphA
 		} else {
-			deemphAvg += (d - fm.deemphA/2) / fm.deemphA
+			fm.deemphAvg += (d - fm.deemphA/2) / fm.deemphA
 		}
-		fm.lowpassed[i] = int16(deemphAvg)
+		fm.lowpassed[i] = int16(fm.deemphAvg)
 	}
 }
 
+// IIR divisor for a de-emphasis time constant in seconds
+func deemphAlpha(rate int, tc float64) int {
+	return int(round(1.0 / (1.0 - math.Exp(-1.0/(float64(rate)*tc)))))
+}
+
 // 0 dB = 1 rms at 50dB gain and 1024 downsample
 func squelchToRms(db int, dongle *dongleState, demod *demodState) int {
 	if db == 0 {
@@ -238,37 +334,16 @@ func squelchToRms(db int, dongle *dongleState, demod *demodState) int {
 	return int(linear) + 1
 }
 
-func softwareAgc(d *demodState) {
-	var peaked bool
-	var output int32
-	for i := 0; i < len(d.lowpassed); i++ {
-		output = int32(d.lowpassed[i])*d.agc.gainNum + int32(d.agc.err)
-		d.agc.err = int(output % d.agc.gainDen)
-		output /= d.agc.gainDen
-
-		if !peaked && int(math.Abs(float64(output))) > d.agc.peakTarget {
-			peaked = true
-		}
-		if peaked {
-			d.agc.gainNum += int32(d.agc.attackStep)
-		} else {
-			d.agc.gainNum += int32(d.agc.decayStep)
-		}
-
-		if d.agc.gainNum < d.agc.gainDen {
-			d.agc.gainNum = d.agc.gainDen
-		}
-		if d.agc.gainNum > d.agc.gainMax {
-			d.agc.gainNum = d.agc.gainMax
-		}
-
-		if output >= (1 << 15) {
-			output = (1 << 15) - 1
-		}
-		if output < -(1 << 15) {
-			output = -(1 << 15) + 1
-		}
-
-		d.lowpassed[i] = int16(output)
+// inverse of squelchToRms, for reporting signal levels in the units of -l
+func rmsToDb(r int, dongle *dongleState, demod *demodState) float64 {
+	if r < 1 {
+		r = 1
 	}
+	gain := 50.0
+	if dongle.gain != autoGain {
+		gain = float64(dongle.gain) / 10.0
+	}
+	gain = math.Pow(10.0, (50.0-gain)/20.0)
+	downsample := 1024.0 / float64(demod.downsample)
+	return 20 * math.Log10(float64(r)*gain*downsample)
 }
@@ -0,0 +1,120 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+const (
+	discSamples = 1 << 16
+	// typical lowPass output for 1M capture at 24k
+	discAmplitude = 2000
+)
+
+// IQ with random phase steps within ±pi/2, the range the input
+// oversampling keeps them to, and the exact angle of each step
+func discSignal() ([]int16, []float64) {
+	r := rand.New(rand.NewSource(1))
+	lp := make([]int16, 2*(discSamples+1))
+	want := make([]float64, discSamples)
+
+	phase := r.Float64() * 2 * math.Pi
+	for i := 0; i <= discSamples; i++ {
+		sin, cos := math.Sincos(phase)
+		lp[2*i] = int16(discAmplitude * cos)
+		lp[2*i+1] = int16(discAmplitude * sin)
+		phase += (r.Float64() - 0.5) * math.Pi
+	}
+	// of the quantised samples
+	for i := range want {
+		a := complex(float64(lp[2*i+2]), float64(lp[2*i+3]))
+		b := complex(float64(lp[2*i]), float64(lp[2*i+1]))
+		d := a * complex(real(b), -imag(b))
+		want[i] = math.Atan2(imag(d), real(d))
+	}
+	return lp, want
+}
+
+func discriminator(name string, lp []int16) func(ar, aj, br, bj int) int {
+	switch name {
+	case "std":
+		return polarDiscriminant
+	case "fast":
+		return polarDiscFast
+	case "lut":
+		return polarDiscLut
+	case "quad":
+		scale := quadScale(lp)
+		return func(ar, aj, br, bj int) int {
+			return polarDiscQuad(ar, aj, br, bj, scale)
+		}
+	}
+	return nil
+}
+
+// rms and max error in degrees
+func discError(disc func(ar, aj, br, bj int) int, lp []int16, want []float64) (float64, float64) {
+	var sum, max float64
+	for i := range want {
+		pcm := disc(int(lp[2*i+2]), int(lp[2*i+3]), int(lp[2*i]), int(lp[2*i+1]))
+		e := math.Abs(float64(pcm)/(1<<14)*180 - want[i]/math.Pi*180)
+		sum += e * e
+		if e > max {
+			max = e
+		}
+	}
+	return math.Sqrt(sum / float64(len(want))), max
+}
+
+func TestDiscriminators(t *testing.T) {
+	lp, want := discSignal()
+	tests := []struct {
+		name        string
+		rms, maxErr float64
+	}{
+		{"std", 0.05, 0.1},
+		{"lut", 0.1, 0.2},
+		{"fast", 4, 6},
+		// sin of the angle, not the angle
+		{"quad", 15, 40},
+	}
+	for _, tt := range tests {
+		rms, max := discError(discriminator(tt.name, lp), lp, want)
+		if rms > tt.rms || max > tt.maxErr {
+			t.Errorf("%s: rms error %.3f° max %.3f°, want under %.3f° and %.3f°", tt.name, rms, max, tt.rms, tt.maxErr)
+		}
+	}
+}
+
+func BenchmarkDiscriminators(b *testing.B) {
+	lp, want := discSignal()
+	for _, name := range []string{"std", "fast", "lut", "quad"} {
+		disc := discriminator(name, lp)
+		b.Run(name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				i := n % discSamples
+				disc(int(lp[2*i+2]), int(lp[2*i+3]), int(lp[2*i]), int(lp[2*i+1]))
+			}
+			b.StopTimer()
+			rms, _ := discError(disc, lp, want)
+			b.ReportMetric(rms, "rms-err-deg")
+		})
+	}
+}
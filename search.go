@@ -0,0 +1,214 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	searchBins = 1024
+	// spectra averaged for each chunk
+	searchFrames = 32
+	// buffers dropped after retuning while the tuner settles
+	searchSettle = 2
+)
+
+// Fast band search
+//
+// Rather than stopping on every channel in turn, the capture the demodulator
+// already uses is swept across the band and only channels standing above the
+// noise floor are handed to the demodulator. Once each of those has been
+// visited the band is swept again.
+type searchState struct {
+	// dB above the noise floor
+	threshold float64
+	spec      *spectrum
+	// raw capture goes to rawChan instead of the demodulator while set,
+	// read by rtlsdrCallback so accessed atomically
+	capturing int32
+	rawChan   chan []byte
+	queue     []int
+}
+
+func newSearch(threshold float64) *searchState {
+	return &searchState{
+		threshold: threshold,
+		spec:      newSpectrum(searchBins),
+		rawChan:   make(chan []byte, 1),
+	}
+}
+
+// Entry to listen to next, -1 if the band is quiet
+func (sr *searchState) next(s *controllerState) int {
+	if len(sr.queue) == 0 {
+		sr.queue = sr.sweep(s)
+	}
+	if len(sr.queue) == 0 {
+		return -1
+	}
+	next := sr.queue[0]
+	sr.queue = sr.queue[1:]
+	return next
+}
+
+// called from rtlsdrCallback while capturing
+func (sr *searchState) add(buf []byte) {
+	raw := make([]byte, len(buf))
+	copy(raw, buf)
+	select {
+	case sr.rawChan <- raw:
+	default:
+	}
+}
+
+// Sweep the band a chunk at a time, returning the entries above the noise
+// floor. The dongle is left tuned as it was.
+func (sr *searchState) sweep(s *controllerState) []int {
+	start := time.Now()
+
+	var idx []int
+	for i, e := range s.entries {
+		if !s.skipped(e, start) {
+			idx = append(idx, i)
+		}
+	}
+	sort.Slice(idx, func(a, b int) bool {
+		return s.entries[idx[a]].freq < s.entries[idx[b]].freq
+	})
+
+	rate := float64(dongle.rate)
+	binHz := rate / searchBins
+	half := rate * usableBandwidth / 2
+	// channel half width
+	width := float64(demod.rateIn) / 4
+
+	atomic.StoreInt32(&sr.capturing, 1)
+	defer func() {
+		atomic.StoreInt32(&sr.capturing, 0)
+		err := dongle.dev.SetCenterFreq(int(dongle.freq))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting frequency %d\n", dongle.freq)
+		}
+		dongle.mute = bufferDump
+	}()
+
+	var active []int
+	chunks := 0
+	for i := 0; i < len(idx); {
+		centre := float64(s.entries[idx[i]].freq) + half - width
+		// keep the DC spike off channels
+		for k := 0; k < 8 && sr.nearDc(s, idx, centre, 2*binHz); k++ {
+			centre -= 4 * binHz
+		}
+
+		err := dongle.dev.SetCenterFreq(int(centre))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting frequency %d\n", int(centre))
+			return nil
+		}
+		db, err := sr.capture()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil
+		}
+		floor := median(db)
+		chunks++
+
+		var chunk []int
+		var peaks []float64
+		for first := true; i < len(idx); first = false {
+			off := float64(s.entries[idx[i]].freq) - centre
+			if !first && off > half-width {
+				break
+			}
+			lo := searchBins/2 + int(math.Floor((off-width)/binHz))
+			hi := searchBins/2 + int(math.Ceil((off+width)/binHz))
+			peak := math.Inf(-1)
+			for b := lo; b <= hi; b++ {
+				// the DC spike isn't a signal
+				if b >= 0 && b < searchBins && (b < searchBins/2-1 || b > searchBins/2+1) && db[b] > peak {
+					peak = db[b]
+				}
+			}
+			chunk = append(chunk, idx[i])
+			peaks = append(peaks, peak-floor)
+			i++
+		}
+
+		for k, e := range chunk {
+			if peaks[k] <= sr.threshold {
+				continue
+			}
+			// a stronger signal on a neighbouring channel leaking into this one
+			if k > 0 && peaks[k-1] > peaks[k] &&
+				s.entries[e].freq-s.entries[chunk[k-1]].freq < uint32(3*width) {
+				continue
+			}
+			if k < len(chunk)-1 && peaks[k+1] > peaks[k] &&
+				s.entries[chunk[k+1]].freq-s.entries[e].freq < uint32(3*width) {
+				continue
+			}
+			active = append(active, e)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Search found %d active of %d channels, %d chunks in %s\n",
+		len(active), len(idx), chunks, time.Since(start).Round(time.Millisecond))
+	return active
+}
+
+// any of the entries within guard of centre
+func (sr *searchState) nearDc(s *controllerState, idx []int, centre, guard float64) bool {
+	for _, i := range idx {
+		if math.Abs(float64(s.entries[i].freq)-centre) < guard {
+			return true
+		}
+	}
+	return false
+}
+
+// averaged spectrum at the current tuning
+func (sr *searchState) capture() ([]float64, error) {
+	timeout := time.After(time.Second)
+	for settle := 0; sr.spec.frames < searchFrames; {
+		select {
+		case buf := <-sr.rawChan:
+			if settle < searchSettle {
+				settle++
+				continue
+			}
+			sr.spec.addRaw(buf)
+		case <-timeout:
+			sr.spec.db()
+			return nil, fmt.Errorf("Search timed out waiting for samples")
+		}
+	}
+	return sr.spec.db(), nil
+}
+
+func median(x []float64) float64 {
+	s := make([]float64, len(x))
+	copy(s, x)
+	sort.Float64s(s)
+	return s[len(s)/2]
+}
@@ -0,0 +1,382 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WGS72, as the element sets are generated with
+const (
+	earthRadius = 6378.135
+	earthMu     = 398600.8
+	sgpJ2       = 0.001082616
+	sgpJ3       = -0.00000253881
+	sgpJ4       = -0.00000165597
+	sgpJ3oJ2    = sgpJ3 / sgpJ2
+	twoThirds   = 2.0 / 3.0
+	twoPi       = 2 * math.Pi
+)
+
+// earth radii per minute
+var sgpXke = 60 / math.Sqrt(earthRadius*earthRadius*earthRadius/earthMu)
+
+// Two line element set, with the SGP4 constants derived from it
+//
+// Only the near earth model is implemented, periods under 225 minutes,
+// which covers weather and amateur satellites in low earth orbit.
+type tle struct {
+	name    string
+	catalog string
+	epoch   time.Time
+	bstar   float64
+	// radians, mean motion in radians per minute
+	incl, node, ecc, argp, mo, no float64
+
+	isimp                                   bool
+	aycof, con41, cc1, cc4, cc5, d2, d3, d4 float64
+	delmo, eta, argpdot, omgcof, sinmao     float64
+	t2cof, t3cof, t4cof, t5cof, x1mth2      float64
+	x7thm1, mdot, nodedot, xlcof, xmcof     float64
+	nodecf                                  float64
+}
+
+// Read every element set in a file of name lines followed by the two lines
+// of elements. Name lines are optional.
+func loadTles(name string) ([]*tle, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tles []*tle
+	var satName, line1 string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \r")
+		switch {
+		case strings.HasPrefix(line, "1 ") && len(line) >= 61:
+			line1 = line
+		case strings.HasPrefix(line, "2 ") && len(line) >= 63 && line1 != "":
+			t, err := parseTle(satName, line1, line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			tles = append(tles, t)
+			satName, line1 = "", ""
+		case strings.TrimSpace(line) != "":
+			satName = strings.TrimSpace(strings.TrimPrefix(line, "0 "))
+		}
+	}
+	return tles, scanner.Err()
+}
+
+func parseTle(name, line1, line2 string) (*tle, error) {
+	field := func(line string, from, to int) string {
+		return strings.TrimSpace(line[from-1 : to])
+	}
+	var err error
+	num := func(line string, from, to int) float64 {
+		v, e := strconv.ParseFloat(field(line, from, to), 64)
+		if e != nil && err == nil {
+			err = fmt.Errorf("bad element '%s'", field(line, from, to))
+		}
+		return v
+	}
+
+	t := &tle{name: name, catalog: field(line1, 3, 7)}
+	if t.name == "" {
+		t.name = t.catalog
+	}
+
+	year := int(num(line1, 19, 20))
+	if year < 57 {
+		year += 2000
+	} else {
+		year += 1900
+	}
+	day := num(line1, 21, 32)
+	t.epoch = time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC).
+		Add(time.Duration((day - 1) * 24 * float64(time.Hour)))
+
+	// implied decimal point and exponent e.g. -11606-4
+	b := field(line1, 54, 61)
+	if len(b) >= 2 {
+		mant := b[:len(b)-2]
+		sign := 1.0
+		if strings.HasPrefix(mant, "-") {
+			sign = -1
+		}
+		mant = strings.TrimLeft(mant, "+-")
+		m, e1 := strconv.ParseFloat("0."+mant, 64)
+		exp, e2 := strconv.Atoi(b[len(b)-2:])
+		if e1 != nil || e2 != nil {
+			return nil, fmt.Errorf("bad drag term '%s'", b)
+		}
+		t.bstar = sign * m * math.Pow(10, float64(exp))
+	}
+
+	deg := math.Pi / 180
+	t.incl = num(line2, 9, 16) * deg
+	t.node = num(line2, 18, 25) * deg
+	t.ecc = num(line2, 27, 33) / 1e7
+	t.argp = num(line2, 35, 42) * deg
+	t.mo = num(line2, 44, 51) * deg
+	t.no = num(line2, 53, 63) * twoPi / 1440
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", t.name, err)
+	}
+
+	err = t.init()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", t.name, err)
+	}
+	return t, nil
+}
+
+// SGP4 initialisation, after Vallado's revision of Spacetrack Report #3
+func (t *tle) init() error {
+	cosio := math.Cos(t.incl)
+	sinio := math.Sin(t.incl)
+	cosio2 := cosio * cosio
+	eccsq := t.ecc * t.ecc
+	omeosq := 1 - eccsq
+	rteosq := math.Sqrt(omeosq)
+
+	// recover the original mean motion from the Kozai value in the elements
+	ak := math.Pow(sgpXke/t.no, twoThirds)
+	d1 := 0.75 * sgpJ2 * (3*cosio2 - 1) / (rteosq * omeosq)
+	del := d1 / (ak * ak)
+	adel := ak * (1 - del*del - del*(1.0/3.0+134*del*del/81))
+	del = d1 / (adel * adel)
+	t.no = t.no / (1 + del)
+
+	if twoPi/t.no >= 225 {
+		return fmt.Errorf("deep space orbits aren't supported")
+	}
+
+	ao := math.Pow(sgpXke/t.no, twoThirds)
+	po := ao * omeosq
+	con42 := 1 - 5*cosio2
+	t.con41 = -con42 - cosio2 - cosio2
+	posq := po * po
+	rp := ao * (1 - t.ecc)
+
+	t.isimp = rp < 220/earthRadius+1
+
+	sfour := 78/earthRadius + 1
+	qzms24 := math.Pow((120-78)/earthRadius, 4)
+	perige := (rp - 1) * earthRadius
+	if perige < 156 {
+		sfour = perige - 78
+		if perige < 98 {
+			sfour = 20
+		}
+		qzms24 = math.Pow((120-sfour)/earthRadius, 4)
+		sfour = sfour/earthRadius + 1
+	}
+
+	pinvsq := 1 / posq
+	tsi := 1 / (ao - sfour)
+	t.eta = ao * t.ecc * tsi
+	etasq := t.eta * t.eta
+	eeta := t.ecc * t.eta
+	psisq := math.Abs(1 - etasq)
+	coef := qzms24 * math.Pow(tsi, 4)
+	coef1 := coef / math.Pow(psisq, 3.5)
+	cc2 := coef1 * t.no * (ao*(1+1.5*etasq+eeta*(4+etasq)) +
+		0.375*sgpJ2*tsi/psisq*t.con41*(8+3*etasq*(8+etasq)))
+	t.cc1 = t.bstar * cc2
+	var cc3 float64
+	if t.ecc > 1e-4 {
+		cc3 = -2 * coef * tsi * sgpJ3oJ2 * t.no * sinio / t.ecc
+	}
+	t.x1mth2 = 1 - cosio2
+	t.cc4 = 2 * t.no * coef1 * ao * omeosq *
+		(t.eta*(2+0.5*etasq) + t.ecc*(0.5+2*etasq) -
+			sgpJ2*tsi/(ao*psisq)*(-3*t.con41*(1-2*eeta+etasq*(1.5-0.5*eeta))+
+				0.75*t.x1mth2*(2*etasq-eeta*(1+etasq))*math.Cos(2*t.argp)))
+	t.cc5 = 2 * coef1 * ao * omeosq * (1 + 2.75*(etasq+eeta) + eeta*etasq)
+
+	cosio4 := cosio2 * cosio2
+	temp1 := 1.5 * sgpJ2 * pinvsq * t.no
+	temp2 := 0.5 * temp1 * sgpJ2 * pinvsq
+	temp3 := -0.46875 * sgpJ4 * pinvsq * pinvsq * t.no
+	t.mdot = t.no + 0.5*temp1*rteosq*t.con41 + 0.0625*temp2*rteosq*(13-78*cosio2+137*cosio4)
+	t.argpdot = -0.5*temp1*con42 + 0.0625*temp2*(7-114*cosio2+395*cosio4) +
+		temp3*(3-36*cosio2+49*cosio4)
+	xhdot1 := -temp1 * cosio
+	t.nodedot = xhdot1 + (0.5*temp2*(4-19*cosio2)+2*temp3*(3-7*cosio2))*cosio
+	t.omgcof = t.bstar * cc3 * math.Cos(t.argp)
+	if t.ecc > 1e-4 {
+		t.xmcof = -twoThirds * coef * t.bstar / eeta
+	}
+	t.nodecf = 3.5 * omeosq * xhdot1 * t.cc1
+	t.t2cof = 1.5 * t.cc1
+	den := 1 + cosio
+	if math.Abs(den) <= 1.5e-12 {
+		den = 1.5e-12
+	}
+	t.xlcof = -0.25 * sgpJ3oJ2 * sinio * (3 + 5*cosio) / den
+	t.aycof = -0.5 * sgpJ3oJ2 * sinio
+	t.delmo = math.Pow(1+t.eta*math.Cos(t.mo), 3)
+	t.sinmao = math.Sin(t.mo)
+	t.x7thm1 = 7*cosio2 - 1
+
+	if !t.isimp {
+		cc1sq := t.cc1 * t.cc1
+		t.d2 = 4 * ao * tsi * cc1sq
+		temp := t.d2 * tsi * t.cc1 / 3
+		t.d3 = (17*ao + sfour) * temp
+		t.d4 = 0.5 * temp * ao * tsi * (221*ao + 31*sfour) * t.cc1
+		t.t3cof = t.d2 + 2*cc1sq
+		t.t4cof = 0.25 * (3*t.d3 + t.cc1*(12*t.d2+10*cc1sq))
+		t.t5cof = 0.2 * (3*t.d4 + 12*t.cc1*t.d3 + 6*t.d2*t.d2 + 15*cc1sq*(2*t.d2+cc1sq))
+	}
+	return nil
+}
+
+// Position (km) and velocity (km/s) in the TEME frame at tsince minutes
+// after the epoch
+func (t *tle) propagate(tsince float64) (r, v [3]float64, err error) {
+	xmdf := t.mo + t.mdot*tsince
+	argpdf := t.argp + t.argpdot*tsince
+	nodedf := t.node + t.nodedot*tsince
+	argpm := argpdf
+	mm := xmdf
+	t2 := tsince * tsince
+	nodem := nodedf + t.nodecf*t2
+	tempa := 1 - t.cc1*tsince
+	tempe := t.bstar * t.cc4 * tsince
+	templ := t.t2cof * t2
+
+	if !t.isimp {
+		delomg := t.omgcof * tsince
+		delm := t.xmcof * (math.Pow(1+t.eta*math.Cos(xmdf), 3) - t.delmo)
+		temp := delomg + delm
+		mm = xmdf + temp
+		argpm = argpdf - temp
+		t3 := t2 * tsince
+		t4 := t3 * tsince
+		tempa = tempa - t.d2*t2 - t.d3*t3 - t.d4*t4
+		tempe = tempe + t.bstar*t.cc5*(math.Sin(mm)-t.sinmao)
+		templ = templ + t.t3cof*t3 + t4*(t.t4cof+tsince*t.t5cof)
+	}
+
+	am := math.Pow(sgpXke/t.no, twoThirds) * tempa * tempa
+	nm := sgpXke / math.Pow(am, 1.5)
+	em := t.ecc - tempe
+	if em >= 1 || em < -0.001 || am < 0.95 {
+		return r, v, fmt.Errorf("%s: elements have decayed", t.name)
+	}
+	if em < 1e-6 {
+		em = 1e-6
+	}
+	mm = mm + t.no*templ
+	xlm := mm + argpm + nodem
+
+	nodem = math.Mod(nodem, twoPi)
+	argpm = math.Mod(argpm, twoPi)
+	xlm = math.Mod(xlm, twoPi)
+	mm = math.Mod(xlm-argpm-nodem, twoPi)
+
+	sinim := math.Sin(t.incl)
+	cosim := math.Cos(t.incl)
+
+	// long period periodics
+	axnl := em * math.Cos(argpm)
+	temp := 1 / (am * (1 - em*em))
+	aynl := em*math.Sin(argpm) + temp*t.aycof
+	xl := mm + argpm + nodem + temp*t.xlcof*axnl
+
+	// solve Kepler's equation
+	u := math.Mod(xl-nodem, twoPi)
+	eo1 := u
+	tem5 := 9999.9
+	var sineo1, coseo1 float64
+	for ktr := 1; math.Abs(tem5) >= 1e-12 && ktr <= 10; ktr++ {
+		sineo1 = math.Sin(eo1)
+		coseo1 = math.Cos(eo1)
+		tem5 = 1 - coseo1*axnl - sineo1*aynl
+		tem5 = (u - aynl*coseo1 + axnl*sineo1 - eo1) / tem5
+		if math.Abs(tem5) >= 0.95 {
+			tem5 = math.Copysign(0.95, tem5)
+		}
+		eo1 += tem5
+	}
+
+	// short period preliminary quantities
+	ecose := axnl*coseo1 + aynl*sineo1
+	esine := axnl*sineo1 - aynl*coseo1
+	el2 := axnl*axnl + aynl*aynl
+	pl := am * (1 - el2)
+	if pl < 0 {
+		return r, v, fmt.Errorf("%s: elements have decayed", t.name)
+	}
+	rl := am * (1 - ecose)
+	rdotl := math.Sqrt(am) * esine / rl
+	rvdotl := math.Sqrt(pl) / rl
+	betal := math.Sqrt(1 - el2)
+	temp = esine / (1 + betal)
+	sinu := am / rl * (sineo1 - aynl - axnl*temp)
+	cosu := am / rl * (coseo1 - axnl + aynl*temp)
+	su := math.Atan2(sinu, cosu)
+	sin2u := (cosu + cosu) * sinu
+	cos2u := 1 - 2*sinu*sinu
+	temp = 1 / pl
+	temp1 := 0.5 * sgpJ2 * temp
+	temp2 := temp1 * temp
+
+	// short period periodics
+	mrt := rl*(1-1.5*temp2*betal*t.con41) + 0.5*temp1*t.x1mth2*cos2u
+	su = su - 0.25*temp2*t.x7thm1*sin2u
+	xnode := nodem + 1.5*temp2*cosim*sin2u
+	xinc := t.incl + 1.5*temp2*cosim*sinim*cos2u
+	mvt := rdotl - nm*temp1*t.x1mth2*sin2u/sgpXke
+	rvdot := rvdotl + nm*temp1*(t.x1mth2*cos2u+1.5*t.con41)/sgpXke
+
+	if mrt < 1 {
+		return r, v, fmt.Errorf("%s: satellite has decayed", t.name)
+	}
+
+	sinsu, cossu := math.Sin(su), math.Cos(su)
+	snod, cnod := math.Sin(xnode), math.Cos(xnode)
+	sini, cosi := math.Sin(xinc), math.Cos(xinc)
+	xmx := -snod * cosi
+	xmy := cnod * cosi
+	ux := [3]float64{xmx*sinsu + cnod*cossu, xmy*sinsu + snod*cossu, sini * sinsu}
+	vx := [3]float64{xmx*cossu - cnod*sinsu, xmy*cossu - snod*sinsu, sini * cossu}
+
+	vkmpersec := earthRadius * sgpXke / 60
+	for i := range r {
+		r[i] = mrt * ux[i] * earthRadius
+		v[i] = (mvt*ux[i] + rvdot*vx[i]) * vkmpersec
+	}
+	return r, v, nil
+}
+
+// Position and velocity at time at
+func (t *tle) at(at time.Time) (r, v [3]float64, err error) {
+	return t.propagate(at.Sub(t.epoch).Minutes())
+}
@@ -0,0 +1,180 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPropagate(t *testing.T) {
+	tests := []struct {
+		name         string
+		line1, line2 string
+		// minutes from epoch, km and km/s
+		tsince float64
+		r, v   [3]float64
+		// the Spacetrack Report #3 results are from the original SGP4,
+		// up to ten metres from Vallado's revision
+		tolR, tolV float64
+	}{
+		// Vallado's verification set, Vanguard 1
+		{"vanguard",
+			"1 00005U 58002B   00179.78495062  .00000023  00000-0  28098-4 0  4753",
+			"2 00005  34.2682 348.7242 1859667 331.7664  19.3264 10.82419157413667",
+			0, [3]float64{7022.46529266, -1400.08296755, 0.03995155},
+			[3]float64{1.893841015, 6.405893759, 4.534807250}, 1e-6, 1e-9},
+		{"vanguard",
+			"1 00005U 58002B   00179.78495062  .00000023  00000-0  28098-4 0  4753",
+			"2 00005  34.2682 348.7242 1859667 331.7664  19.3264 10.82419157413667",
+			360, [3]float64{-7154.03120202, -3783.17682504, -3536.19412294},
+			[3]float64{4.741887409, -4.151817765, -2.093935425}, 1e-6, 1e-9},
+		{"vanguard",
+			"1 00005U 58002B   00179.78495062  .00000023  00000-0  28098-4 0  4753",
+			"2 00005  34.2682 348.7242 1859667 331.7664  19.3264 10.82419157413667",
+			720, [3]float64{-7134.59340119, 6531.68641334, 3260.27186483},
+			[3]float64{-4.113793027, -2.911922039, -2.557327851}, 1e-6, 1e-9},
+		// Spacetrack Report #3 test case
+		{"88888",
+			"1 88888U          80275.98708465  .00073094  13844-3  66816-4 0    87",
+			"2 88888  72.8435 115.9689 0086731  52.6988 110.5714 16.05824518  1058",
+			0, [3]float64{2328.97048951, -5995.22076416, 1719.97067261},
+			[3]float64{2.91207230, -0.98341546, -7.09081703}, 0.02, 2e-5},
+		{"88888",
+			"1 88888U          80275.98708465  .00073094  13844-3  66816-4 0    87",
+			"2 88888  72.8435 115.9689 0086731  52.6988 110.5714 16.05824518  1058",
+			1440, [3]float64{2742.55133057, -6079.67144775, -326.38095856},
+			[3]float64{1.94850229, 1.21106251, -7.35619372}, 0.02, 2e-5},
+	}
+	for _, tt := range tests {
+		sat, err := parseTle(tt.name, tt.line1, tt.line2)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		r, v, err := sat.propagate(tt.tsince)
+		if err != nil {
+			t.Errorf("%s at %.0f: %s", tt.name, tt.tsince, err)
+			continue
+		}
+		for i := range r {
+			if math.Abs(r[i]-tt.r[i]) > tt.tolR || math.Abs(v[i]-tt.v[i]) > tt.tolV {
+				t.Errorf("%s at %.0f: r %.8f v %.9f, want r %.8f v %.9f", tt.name, tt.tsince, r, v, tt.r, tt.v)
+				break
+			}
+		}
+	}
+}
+
+func TestParseTle(t *testing.T) {
+	line1 := "1 00005U 58002B   00179.78495062  .00000023  00000-0  28098-4 0  4753"
+	line2 := "2 00005  34.2682 348.7242 1859667 331.7664  19.3264 10.82419157413667"
+	sat, err := parseTle("", line1, line2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sat.name != "00005" || sat.catalog != "00005" {
+		t.Errorf("unnamed set called '%s', catalogue '%s'", sat.name, sat.catalog)
+	}
+	// day 179.78495062 of 2000
+	epoch := time.Date(2000, time.June, 27, 18, 50, 19, 733568000, time.UTC)
+	if d := sat.epoch.Sub(epoch); d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("epoch %s, want %s", sat.epoch, epoch)
+	}
+	if math.Abs(sat.bstar-0.28098e-4) > 1e-12 {
+		t.Errorf("drag term %g, want 0.28098e-4", sat.bstar)
+	}
+
+	bad := []struct {
+		name, line1, line2 string
+	}{
+		{"bad element", line1, strings.Replace(line2, "34.2682", "34.26x2", 1)},
+		{"bad drag", strings.Replace(line1, "28098-4", "28x98-4", 1), line2},
+		// GPS, a 12 hour orbit
+		{"deep space",
+			"1 20959U 90103A   24001.50000000  .00000000  00000-0  00000-0 0  9990",
+			"2 20959  54.0000 100.0000 0100000  90.0000 270.0000  2.00560000    00"},
+	}
+	for _, tt := range bad {
+		if _, err := parseTle(tt.name, tt.line1, tt.line2); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestLoadTles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "weather.txt")
+	data := "VANGUARD 1\r\n" +
+		"1 00005U 58002B   00179.78495062  .00000023  00000-0  28098-4 0  4753\r\n" +
+		"2 00005  34.2682 348.7242 1859667 331.7664  19.3264 10.82419157413667\r\n" +
+		"1 88888U          80275.98708465  .00073094  13844-3  66816-4 0    87\n" +
+		"2 88888  72.8435 115.9689 0086731  52.6988 110.5714 16.05824518  1058\n"
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tles, err := loadTles(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tles) != 2 || tles[0].name != "VANGUARD 1" || tles[1].name != "88888" {
+		t.Fatalf("read %d element sets %v", len(tles), tles)
+	}
+}
+
+func TestGmst(t *testing.T) {
+	tests := []struct {
+		at time.Time
+		// degrees
+		want float64
+	}{
+		{time.Date(2000, time.January, 1, 12, 0, 0, 0, time.UTC), 280.46061837},
+		// Vallado example 3-5
+		{time.Date(1992, time.August, 20, 12, 14, 0, 0, time.UTC), 152.578787810},
+	}
+	for _, tt := range tests {
+		got := gmst(tt.at) * 180 / math.Pi
+		if math.Abs(got-tt.want) > 1e-4 {
+			t.Errorf("%s: %.6f°, want %.6f°", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestDoppler(t *testing.T) {
+	tests := []struct {
+		// km/s, positive moving away
+		rate float64
+		want int
+	}{
+		{0, 0},
+		{-7, 3201},
+		{7, -3201},
+	}
+	for _, tt := range tests {
+		if got := (lookAngles{rate: tt.rate}).doppler(137100000); got != tt.want {
+			t.Errorf("%.0f km/s: %d Hz, want %d Hz", tt.rate, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// one logical stream of a chained Ogg FLAC stream, as a FLAC file
+type oggLogical struct {
+	serial   uint32
+	flac     []byte
+	packets  int
+	granule  uint64
+	finished bool
+}
+
+// Split Ogg pages, each holding one packet, into their logical streams
+func splitOgg(data []byte) ([]*oggLogical, error) {
+	var streams []*oggLogical
+	var cur *oggLogical
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[:4]) != "OggS" {
+			return nil, fmt.Errorf("no page")
+		}
+		flags := data[5]
+		granule := binary.LittleEndian.Uint64(data[6:])
+		serial := binary.LittleEndian.Uint32(data[14:])
+		segments := int(data[26])
+		size := 0
+		for _, s := range data[27 : 27+segments] {
+			size += int(s)
+		}
+		page := append([]byte(nil), data[:27+segments+size]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if oggCrc(page) != crc {
+			return nil, fmt.Errorf("page CRC")
+		}
+		packet := data[27+segments : 27+segments+size]
+		data = data[27+segments+size:]
+
+		if flags&0x02 != 0 {
+			if cur != nil && !cur.finished {
+				return nil, fmt.Errorf("stream %d not ended before the next", cur.serial)
+			}
+			if len(packet) < 13 || string(packet[:9]) != "\x7fFLAC\x01\x00\x00\x01" {
+				return nil, fmt.Errorf("bad mapping header")
+			}
+			cur = &oggLogical{serial: serial, flac: append([]byte(nil), packet[9:]...)}
+			streams = append(streams, cur)
+			continue
+		}
+		if cur == nil || serial != cur.serial || cur.finished {
+			return nil, fmt.Errorf("page of stream %d out of place", serial)
+		}
+		cur.flac = append(cur.flac, packet...)
+		cur.packets++
+		cur.granule = granule
+		cur.finished = flags&0x04 != 0
+	}
+	return streams, nil
+}
+
+func TestOggChain(t *testing.T) {
+	var buf bytes.Buffer
+	o, err := newOggFlac(&buf, 24000, []string{"TITLE=one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a part block left over, none at all and several blocks
+	parts := [][]int16{flacSignal(2500, 1), nil, flacSignal(10000, 2)}
+	titles := []string{"TITLE=two", "TITLE=three"}
+	for i, x := range parts {
+		if err := o.write(x); err != nil {
+			t.Fatal(err)
+		}
+		if i < len(titles) {
+			if err := o.chain([]string{titles[i]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	streams, err := splitOgg(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 3 {
+		t.Fatalf("%d logical streams, want 3", len(streams))
+	}
+	for i, s := range streams {
+		if i < 2 && !s.finished {
+			t.Errorf("stream %d not ended", i)
+		}
+		if i > 0 && s.serial == streams[i-1].serial {
+			t.Errorf("stream %d has the serial of the one before", i)
+		}
+		// STREAMINFO follows fLaC and its block header
+		minBlock, maxBlock := binary.BigEndian.Uint16(s.flac[8:]), binary.BigEndian.Uint16(s.flac[10:])
+		if minBlock != streamBlock || maxBlock != streamBlock {
+			t.Errorf("stream %d: STREAMINFO blocks %d to %d, want %d", i, minBlock, maxBlock, streamBlock)
+		}
+		d, err := decodeFlac(s.flac)
+		if err != nil {
+			t.Fatalf("stream %d: %s", i, err)
+		}
+		want := []string{"TITLE=one", "TITLE=two", "TITLE=three"}[i]
+		if len(d.tags) != 1 || d.tags[0] != want {
+			t.Errorf("stream %d: tags %v, want %s", i, d.tags, want)
+		}
+		x := parts[i]
+		switch {
+		case i == 1:
+			// ended with a sample of silence
+			x = []int16{0}
+		case i == 2:
+			// the last part block is still pending
+			x = x[:len(x)/streamBlock*streamBlock]
+		}
+		if len(d.samples) != len(x) || s.granule != uint64(len(x)) {
+			t.Fatalf("stream %d: %d samples to granule %d, want %d", i, len(d.samples), s.granule, len(x))
+		}
+		for j := range x {
+			if d.samples[j] != x[j] {
+				t.Fatalf("stream %d: sample %d is %d, want %d", i, j, d.samples[j], x[j])
+			}
+		}
+	}
+}
+
+func TestHeaderValue(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"hamsdr 145.500MHz Simplex", "hamsdr 145.500MHz Simplex"},
+		{"hamsdr 145.500MHz Evil\r\nIce-Public: 1", "hamsdr 145.500MHz Evil  Ice-Public: 1"},
+		{"two\nlines", "two lines"},
+	}
+	for _, tt := range tests {
+		if got := headerValue(tt.in); got != tt.want {
+			t.Errorf("%q: %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
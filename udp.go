@@ -0,0 +1,127 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	// bytes per datagram, as sent by GQRX
+	udpPayload = 1024
+	// blocks queued before samples are dropped
+	udpQueue = 64
+)
+
+// Sends samples to host:port in fixed size datagrams, from its own
+// goroutine so a slow network never holds up the caller
+//
+// Audio is little endian int16 like GQRX's UDP output, IQ is interleaved
+// little endian float32 I and Q scaled to ±1 as GNU Radio uses.
+type udpSink struct {
+	addr string
+	iq   bool
+	conn net.Conn
+	ch   chan []int16
+	done chan bool
+
+	pending []byte
+	dropped int
+	failed  bool
+}
+
+func newUdpSink(addr string, iq bool) (*udpSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &udpSink{
+		addr: addr,
+		iq:   iq,
+		conn: conn,
+		ch:   make(chan []int16, udpQueue),
+		done: make(chan bool),
+	}
+	go s.run()
+	return s, nil
+}
+
+// queue buf, dropping it if the queue is full
+func (s *udpSink) send(buf []int16) {
+	select {
+	case s.ch <- buf:
+	default:
+		s.dropped++
+	}
+}
+
+func (s *udpSink) run() {
+	defer close(s.done)
+	for buf := range s.ch {
+		for _, v := range buf {
+			var b [4]byte
+			if s.iq {
+				binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(v)/128))
+				s.pending = append(s.pending, b[:]...)
+			} else {
+				binary.LittleEndian.PutUint16(b[:], uint16(v))
+				s.pending = append(s.pending, b[:2]...)
+			}
+		}
+		n := 0
+		for ; len(s.pending)-n >= udpPayload; n += udpPayload {
+			_, err := s.conn.Write(s.pending[n : n+udpPayload])
+			// a decoder not running yet is no reason to stop, only say so once
+			if err != nil && !s.failed {
+				fmt.Fprintf(os.Stderr, "UDP %s: %s\n", s.addr, err)
+				s.failed = true
+			}
+		}
+		s.pending = append(s.pending[:0], s.pending[n:]...)
+	}
+}
+
+// stop once everything queued is sent
+func (s *udpSink) close() {
+	close(s.ch)
+	<-s.done
+	s.conn.Close()
+	if s.dropped > 0 {
+		fmt.Fprintf(os.Stderr, "UDP %s: dropped %d blocks\n", s.addr, s.dropped)
+	}
+}
+
+// -udp and -udp-iq values, host:port
+type udpAddrs []string
+
+func (a *udpAddrs) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *udpAddrs) Set(val string) error {
+	_, _, err := net.SplitHostPort(val)
+	if err != nil {
+		return err
+	}
+	*a = append(*a, val)
+	return nil
+}
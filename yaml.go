@@ -0,0 +1,270 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// One item of a YAML list, keys lowercased. Values are kept as written,
+// so 07:00 is a time rather than a number as YAML 1.1 would have it.
+type yamlItem struct {
+	line    int
+	scalars map[string]string
+	lists   map[string][]string
+}
+
+// Read the subset of YAML used by scan lists and schedules, a list of
+// mappings whose values are scalars, [flow, lists] or block lists of
+// scalars. Anchors, tags, multi-line strings and nested mappings aren't
+// supported.
+func readYaml(r io.Reader) ([]*yamlItem, error) {
+	var items []*yamlItem
+	var item *yamlItem
+	// indent of the item's keys, and of the item markers
+	keyIndent, itemIndent := -1, -1
+	// key of an empty value, which may be followed by a block list
+	listKey := ""
+
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		text := yamlStripComment(scanner.Text())
+		body := strings.TrimLeft(text, " ")
+		if body == "" || (len(text) == 3 && (text == "---" || text == "...")) {
+			continue
+		}
+		if strings.HasPrefix(body, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used to indent", n)
+		}
+		indent := len(text) - len(body)
+
+		// an element of the block list under listKey, which may be
+		// indented as far as the key
+		if item != nil && listKey != "" && indent >= keyIndent && yamlIsItem(body) {
+			v, err := yamlScalar(strings.TrimSpace(body[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			item.lists[listKey] = append(item.lists[listKey], v)
+			continue
+		}
+
+		if yamlIsItem(body) {
+			if itemIndent >= 0 && indent != itemIndent {
+				return nil, fmt.Errorf("line %d: expected a list of mappings", n)
+			}
+			itemIndent = indent
+			item = &yamlItem{
+				line:    n,
+				scalars: make(map[string]string),
+				lists:   make(map[string][]string),
+			}
+			items = append(items, item)
+			listKey = ""
+			rest := strings.TrimLeft(body[1:], " ")
+			if rest == "" {
+				// keys start on the next line
+				keyIndent = -1
+				continue
+			}
+			indent += len(body) - len(rest)
+			body = rest
+			keyIndent = indent
+		}
+
+		if item == nil {
+			return nil, fmt.Errorf("line %d: expected a list of mappings", n)
+		}
+		if keyIndent < 0 && indent > itemIndent {
+			keyIndent = indent
+		}
+		if indent != keyIndent {
+			return nil, fmt.Errorf("line %d: bad indentation", n)
+		}
+
+		key, value, err := yamlKeyValue(body)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		_, dupScalar := item.scalars[key]
+		_, dupList := item.lists[key]
+		if dupScalar || dupList {
+			return nil, fmt.Errorf("line %d: '%s' given twice", n, key)
+		}
+		listKey = ""
+		switch {
+		case value == "":
+			item.lists[key] = nil
+			listKey = key
+		case strings.HasPrefix(value, "["):
+			item.lists[key], err = yamlFlowList(value)
+		default:
+			item.scalars[key], err = yamlScalar(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// empty values with no list following are empty scalars
+	for _, item := range items {
+		for k, l := range item.lists {
+			if l == nil {
+				item.scalars[k] = ""
+				delete(item.lists, k)
+			}
+		}
+	}
+	return items, nil
+}
+
+// value of a key that should have a single value
+func (y *yamlItem) scalar(key string) (string, error) {
+	if _, ok := y.lists[key]; ok {
+		return "", fmt.Errorf("expected a single value for '%s'", key)
+	}
+	return y.scalars[key], nil
+}
+
+// value of a key that may be a list, a single value is a list of one
+func (y *yamlItem) list(key string) []string {
+	if v, ok := y.scalars[key]; ok && v != "" {
+		return []string{v}
+	}
+	return y.lists[key]
+}
+
+func yamlIsItem(body string) bool {
+	return body == "-" || strings.HasPrefix(body, "- ")
+}
+
+// drop a comment, a # at the start or after a space, outside quotes
+func yamlStripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return strings.TrimRight(line, " \t")
+}
+
+// split key: value, the colon must be followed by a space or end the line
+func yamlKeyValue(body string) (string, string, error) {
+	i := strings.Index(body, ": ")
+	if i < 0 {
+		if !strings.HasSuffix(body, ":") {
+			return "", "", fmt.Errorf("expected key: value")
+		}
+		i = len(body) - 1
+	}
+	key, err := yamlScalar(strings.TrimSpace(body[:i]))
+	if err != nil {
+		return "", "", err
+	}
+	if key == "" {
+		return "", "", fmt.Errorf("empty key")
+	}
+	return strings.ToLower(key), strings.TrimSpace(body[i+1:]), nil
+}
+
+// plain or quoted scalar, ~ and null are empty
+func yamlScalar(s string) (string, error) {
+	switch {
+	case s == "~" || s == "null":
+		return "", nil
+	case strings.HasPrefix(s, "\""):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("bad quoted value %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("bad quoted value %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") || strings.HasPrefix(s, "&") ||
+		strings.HasPrefix(s, "*") || strings.HasPrefix(s, "!") || strings.HasPrefix(s, "|") ||
+		strings.HasPrefix(s, ">"):
+		return "", fmt.Errorf("unsupported value %s", s)
+	}
+	return s, nil
+}
+
+// [a, "b", c]
+func yamlFlowList(s string) ([]string, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated list %s", s)
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	list := []string{}
+	if s == "" {
+		return list, nil
+	}
+
+	var quote byte
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) {
+			c := s[i]
+			switch {
+			case quote != 0:
+				if c == '\\' && quote == '"' {
+					i++
+				} else if c == quote {
+					quote = 0
+				}
+				continue
+			case c == '"' || c == '\'':
+				quote = c
+				continue
+			case c != ',':
+				continue
+			}
+		}
+		v, err := yamlScalar(strings.TrimSpace(s[start:i]))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		start = i + 1
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %s", s)
+	}
+	return list, nil
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2014 Ian Bishop
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadYaml(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		scalars []map[string]string
+		lists   []map[string][]string
+	}{
+		{
+			name: "scan list",
+			in: `# repeaters
+- label: Simplex
+  frequency: 145.5M   # calling
+  tone: 88.5
+- label: "Repeater #2"
+  Frequency: 146.94M
+`,
+			scalars: []map[string]string{
+				{"label": "Simplex", "frequency": "145.5M", "tone": "88.5"},
+				{"label": "Repeater #2", "frequency": "146.94M"},
+			},
+			lists: []map[string][]string{{}, {}},
+		},
+		{
+			name: "schedule",
+			in: `---
+- name: 2m net
+  frequencies: [146.52M, "147.0M:147.2M:25k"]
+  start: "20:00"
+  stop: 21:00
+  days:
+    - tue
+    - 'thu'
+- name: weather
+  days:
+  - weekends
+  output:
+`,
+			scalars: []map[string]string{
+				{"name": "2m net", "start": "20:00", "stop": "21:00"},
+				{"name": "weather", "output": ""},
+			},
+			lists: []map[string][]string{
+				{"frequencies": {"146.52M", "147.0M:147.2M:25k"}, "days": {"tue", "thu"}},
+				{"days": {"weekends"}},
+			},
+		},
+		{
+			name: "keys on the next line",
+			in: `-
+  label: it's
+  mode: ~
+-   label: 'it''s'
+    filters: []
+`,
+			scalars: []map[string]string{
+				{"label": "it's", "mode": ""},
+				{"label": "it's"},
+			},
+			lists: []map[string][]string{{}, {"filters": {}}},
+		},
+		{
+			name: "empty",
+			in:   "# nothing\n\n",
+		},
+	}
+	for _, tt := range tests {
+		items, err := readYaml(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if len(items) != len(tt.scalars) {
+			t.Errorf("%s: %d items, want %d", tt.name, len(items), len(tt.scalars))
+			continue
+		}
+		for i, item := range items {
+			if !reflect.DeepEqual(item.scalars, tt.scalars[i]) {
+				t.Errorf("%s item %d: %v, want %v", tt.name, i+1, item.scalars, tt.scalars[i])
+			}
+			if !reflect.DeepEqual(item.lists, tt.lists[i]) {
+				t.Errorf("%s item %d: %v, want %v", tt.name, i+1, item.lists, tt.lists[i])
+			}
+		}
+	}
+}
+
+func TestReadYamlErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"not a list", "label: Simplex\n", "line 1: expected a list of mappings"},
+		{"tab", "- label: a\n\tmode: fm\n", "line 2: tabs"},
+		{"indent", "- label: a\n   mode: fm\n", "line 2: bad indentation"},
+		{"nested item", "- label: a\n  - mode: fm\n", "line 2: expected a list of mappings"},
+		{"no colon", "- label a\n", "line 1: expected key: value"},
+		{"twice", "- label: a\n  label: b\n", "line 2: 'label' given twice"},
+		{"mapping", "- label: {a: b}\n", "line 1: unsupported value"},
+		{"quote", "- label: \"a\n", "line 1: bad quoted value"},
+		{"list", "- days: [mon, tue\n", "line 1: unterminated list"},
+	}
+	for _, tt := range tests {
+		_, err := readYaml(strings.NewReader(tt.in))
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}